@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// runCommand runs the maintenance command given on the command line
+func runCommand(args []string) error {
+	switch args[0] {
+	case "regenerate":
+		return regenerateConfigs()
+	case "quiesce", "resume":
+		if len(args) != 2 {
+			return errors.Errorf("usage: %s <network>", args[0])
+		}
+		return setQuiesced(args[1], args[0] == "quiesce")
+	case "import":
+		if len(args) != 3 {
+			return errors.Errorf("usage: import <network> <hosts file>")
+		}
+		return importHosts(args[1], args[2])
+	case "reserve":
+		if len(args) < 3 {
+			return errors.Errorf("usage: reserve <network> <name> [alias...]")
+		}
+		return reserveName(args[1], args[2], args[3:], true)
+	case "release":
+		if len(args) != 3 {
+			return errors.Errorf("usage: release <network> <name>")
+		}
+		return reserveName(args[1], args[2], nil, false)
+	case "update":
+		if len(args) < 4 {
+			return errors.Errorf("usage: update <network> <name> <ip> [ip...]")
+		}
+		return updateEntry(args[1], args[2], args[3:])
+	case "split-dns":
+		if len(args) < 3 {
+			return errors.Errorf("usage: split-dns <network> <domain> [upstream...]")
+		}
+		return splitDNSCommand(args[1], args[2], args[3:])
+	case "gc":
+		return gcCommand(args[1:])
+	case "export":
+		if len(args) != 2 {
+			return errors.Errorf("usage: export <network>")
+		}
+		return exportNetwork(args[1])
+	case "restore":
+		if len(args) != 2 {
+			return errors.Errorf("usage: restore <state file>")
+		}
+		return restoreNetwork(args[1])
+	case "restore-snapshots":
+		if len(args) != 2 {
+			return errors.Errorf("usage: restore-snapshots <persist dir>")
+		}
+		return restoreSnapshots(args[1])
+	case "apply":
+		if len(args) != 3 {
+			return errors.Errorf("usage: apply <network> <entries file>")
+		}
+		return applyEntries(args[1], args[2])
+	case "dry-run":
+		if len(args) < 5 {
+			return errors.Errorf("usage: dry-run <plugin config> <interface> <name> <ip> [ip...]")
+		}
+		return dryRunCommand(args[1], args[2], args[3], args[4:])
+	case "instances":
+		return listInstancesCommand()
+	case execLimitedCommand:
+		// internal, used to start dnsmasq under the memory limit
+		if len(args) < 3 {
+			return errors.Errorf("usage: %s <max memory MB> <binary> [arg...]", execLimitedCommand)
+		}
+		return execLimited(args[1:])
+	case "status":
+		if len(args) > 2 {
+			return errors.Errorf("usage: status [iptables|nftables]")
+		}
+		backend := firewallIPTables
+		if len(args) == 2 {
+			backend = args[1]
+		}
+		// CNI STATUS verb is not supported by the used CNI version, the
+		// node readiness is reported by this command instead
+		if err := newFirewall(backend, false).probe(); err != nil {
+			return err
+		}
+		fmt.Println("ok")
+		return nil
+	default:
+		return errors.Errorf("unknown command %q", args[0])
+	}
+}
+
+// dryRunCommand prints the artifacts of the pod entry added to the network of
+// the plugin config without touching the system
+func dryRunCommand(configFile, iface, podname string, addresses []string) error {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	var netConf DNSNameConf
+	if err := json.Unmarshal(data, &netConf); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", configFile)
+	}
+	conf, err := newDNSMasqFileFromConf(&netConf, iface)
+	if err != nil {
+		return err
+	}
+	ips, err := parseIPs(addresses)
+	if err != nil {
+		return err
+	}
+	artifacts, err := dryRunNetwork(conf, PodEntry{Name: podname, IPs: ips})
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(artifacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// setQuiesced quiesces or resumes the dnsmasq instance of the network
+func setQuiesced(networkName string, quiesced bool) error {
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	conf, err := loadDNSMasqFile(networkName)
+	if err != nil {
+		return err
+	}
+	if quiesced {
+		return conf.quiesce()
+	}
+	return conf.resume()
+}
+
+// reserveName reserves or releases the name in the network before the pod IP
+// is known. Reservations are not served, so dnsmasq is not reloaded.
+func reserveName(networkName, podname string, aliases []string, reserve bool) error {
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	conf, err := loadDNSMasqFile(networkName)
+	if err != nil {
+		return err
+	}
+	if reserve {
+		return reserveInFile(conf.AddOnHostsFile, podname, aliases, conf.fileMode())
+	}
+	return releaseInFile(conf.AddOnHostsFile, podname)
+}
+
+// parseIPs parses the addresses given on the command line
+func parseIPs(addresses []string) ([]*net.IPNet, error) {
+	ips := make([]*net.IPNet, 0, len(addresses))
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, errors.Errorf("invalid address %q", address)
+		}
+		ips = append(ips, &net.IPNet{IP: ip})
+	}
+	return ips, nil
+}
+
+// updateEntry replaces the addresses of the pod entry keeping its aliases, the
+// entry is never missing during the update
+func updateEntry(networkName, podname string, addresses []string) error {
+	ips, err := parseIPs(addresses)
+	if err != nil {
+		return err
+	}
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	conf, err := loadDNSMasqFile(networkName)
+	if err != nil {
+		return err
+	}
+	entries, err := readHostEntries(conf.AddOnHostsFile)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if hostNameKey(entry.Name) == hostNameKey(podname) {
+			if err := updateFile(conf.AddOnHostsFile, entry.Name, entry.Aliases, ips); err != nil {
+				return err
+			}
+			return conf.hup()
+		}
+	}
+	return errors.Errorf("pod %s is not found in network %s", podname, networkName)
+}
+
+// splitDNSCommand forwards the queries of the domain from the network to the
+// upstreams, no upstreams stop forwarding the domain
+func splitDNSCommand(networkName, domain string, upstreams []string) error {
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	conf, err := loadDNSMasqFile(networkName)
+	if err != nil {
+		return err
+	}
+	_, err = conf.updateSplitDNS(domain, upstreams)
+	return err
+}
+
+// exportNetwork prints the managed state of the network as JSON
+func exportNetwork(networkName string) error {
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	state, err := exportState(networkName)
+	if err != nil {
+		return err
+	}
+	data, err := marshalState(state)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// listInstancesCommand prints the status of the dnsmasq instances of all
+// networks as JSON
+func listInstancesCommand() error {
+	statuses, err := listInstances()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// restoreNetwork restores the network from the state exported to the file
+func restoreNetwork(statePath string) error {
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return err
+	}
+	state, err := unmarshalState(data)
+	if err != nil {
+		return err
+	}
+	// the configuration directory is missing after reboot
+	if err := os.MkdirAll(dnsNameConfPath(), 0700); err != nil {
+		return err
+	}
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	return restoreState(state)
+}
+
+// restoreSnapshots restores all networks from the snapshots in the persist
+// directory, e.g. after reboot
+func restoreSnapshots(persistDir string) error {
+	snapshots, err := filepath.Glob(filepath.Join(persistDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, snapshot := range snapshots {
+		if err := restoreNetwork(snapshot); err != nil {
+			logrus.Errorf("unable to restore snapshot %s: %v", snapshot, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to restore %d networks", failed)
+	}
+	return nil
+}
+
+// applyEntries replaces the entries of the network with the entries in the
+// JSON file, in the format of the exported network state entries
+func applyEntries(networkName, entriesPath string) error {
+	data, err := ioutil.ReadFile(entriesPath)
+	if err != nil {
+		return err
+	}
+	var desired []PodEntry
+	if err := json.Unmarshal(data, &desired); err != nil {
+		return errors.Wrap(err, "invalid entries")
+	}
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	conf, err := loadDNSMasqFile(networkName)
+	if err != nil {
+		return err
+	}
+	changed, err := replaceEntries(conf, desired)
+	if err != nil || !changed {
+		return err
+	}
+	return conf.hup()
+}
+
+// importHosts imports the entries of the hosts file into the network
+func importHosts(networkName, sourcePath string) error {
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	conf, err := loadDNSMasqFile(networkName)
+	if err != nil {
+		return err
+	}
+	imported, err := importHostsFile(conf.AddOnHostsFile, sourcePath, conf.fileMode())
+	if imported > 0 {
+		logrus.Infof("imported %d entries into network %s", imported, networkName)
+		if err := conf.hup(); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// regenerateConfigs regenerates the configuration of all managed networks, e.g.
+// after the plugin upgrade, and restarts the dnsmasq instances whose
+// configuration has changed
+func regenerateConfigs() error {
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	items, err := ioutil.ReadDir(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, item := range items {
+		if !item.IsDir() {
+			continue
+		}
+		conf, err := loadDNSMasqFile(item.Name())
+		if err != nil {
+			if os.IsNotExist(err) {
+				logrus.Warnf("network %s has no stored options, skipping", item.Name())
+				continue
+			}
+			logrus.Errorf("unable to load network %s: %v", item.Name(), err)
+			failed++
+			continue
+		}
+		if err := regenerateConfig(conf); err != nil {
+			logrus.Errorf("unable to regenerate network %s: %v", item.Name(), err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to regenerate %d networks", failed)
+	}
+	return nil
+}
+
+// regenerateConfig rewrites the dnsmasq configuration if it differs from the
+// generated one and restarts the running dnsmasq instance
+func regenerateConfig(conf dnsNameFile) error {
+	newConfig, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		return err
+	}
+	curConfig, err := ioutil.ReadFile(conf.ConfigFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the header changes with every generation, so the configs are the same if
+	// the bodies are equal and the header is present as configured
+	curChecksum, curBody := splitConfigHeader(curConfig)
+	_, newBody := splitConfigHeader(newConfig)
+	if bytes.Equal(curBody, newBody) && (curChecksum != "") == conf.ConfigChecksum {
+		return nil
+	}
+	if modified, err := configWasModified(conf.ConfigFile); err == nil && modified {
+		logrus.Warnf("overwriting %s modified outside of the plugin", conf.ConfigFile)
+	}
+	if err := writeFileAtomic(conf.ConfigFile, newConfig, conf.fileMode()); err != nil {
+		return err
+	}
+	logrus.Infof("regenerated %s", conf.ConfigFile)
+	if isRunning, _ := conf.isRunning(); isRunning {
+		return conf.restart()
+	}
+	return nil
+}
+
+// gcCommand removes the networks of the interfaces not given on the command
+// line, by default of the interfaces which don't exist on the node
+func gcCommand(knownInterfaces []string) error {
+	if len(knownInterfaces) == 0 {
+		interfaces, err := net.Interfaces()
+		if err != nil {
+			return err
+		}
+		for _, iface := range interfaces {
+			knownInterfaces = append(knownInterfaces, iface.Name)
+		}
+	}
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	return gc(knownInterfaces)
+}
+
+// gc removes the orphaned networks whose interface is not among the known ones,
+// e.g. left by the crashed DEL: the dnsmasq instance is terminated, the firewall
+// rules are removed and the network directory is deleted. The failures are
+// logged and the other networks are still collected. It must be called under
+// the lock.
+func gc(knownInterfaces []string) error {
+	items, err := ioutil.ReadDir(dnsNameConfPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	failed := 0
+	for _, item := range items {
+		if !item.IsDir() {
+			continue
+		}
+		conf, err := loadDNSMasqFile(item.Name())
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logrus.Errorf("unable to load network %s: %v", item.Name(), err)
+				failed++
+				continue
+			}
+			// the network setup hasn't completed, the interface is known from
+			// the claim only
+			conf = dnsNameFile{
+				ConfigFile:    makePath(item.Name(), confFileName),
+				PidFile:       makePath(item.Name(), pidFileName),
+				InterfaceFile: makePath(item.Name(), interfaceFileName),
+			}
+			if data, err := ioutil.ReadFile(conf.InterfaceFile); err == nil {
+				conf.NetworkInterface = strings.TrimSpace(string(data))
+			}
+		}
+		if conf.NetworkInterface != "" && stringInSlice(conf.NetworkInterface, knownInterfaces) {
+			continue
+		}
+		logrus.Infof("removing orphaned network %s of interface %q", item.Name(), conf.NetworkInterface)
+		if err := removeNetwork(conf); err != nil {
+			logrus.Errorf("unable to remove orphaned network %s: %v", item.Name(), err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to collect %d networks", failed)
+	}
+	return nil
+}
+
+// removeNetwork tears down the network under the lock of its directory
+func removeNetwork(conf dnsNameFile) error {
+	networkDir := filepath.Dir(conf.PidFile)
+	lock, err := getLock(networkDir)
+	if err != nil {
+		return err
+	}
+	if err := lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", networkDir, err)
+		}
+	}()
+	if err := conf.terminate(); err != nil {
+		return err
+	}
+	if conf.NetworkInterface != "" {
+		if err := conf.firewall().removeAllow(conf.NetworkInterface, conf.port()); err != nil {
+			return err
+		}
+	}
+	if err := conf.removeSnapshot(); err != nil {
+		logrus.Errorf("unable to remove network state snapshot: %v", err)
+	}
+	return os.RemoveAll(networkDir)
+}
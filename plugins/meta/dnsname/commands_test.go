@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRegenerateConfigs(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	var configs []dnsNameFile
+	for _, networkName := range []string{"net1", "net2"} {
+		if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), networkName), 0700); err != nil {
+			t.Fatalf("Can't create network dir: %v", err)
+		}
+		conf := dnsNameFile{
+			AddOnHostsFile:   makePath(networkName, hostsFileName),
+			ConfigFile:       makePath(networkName, confFileName),
+			Domain:           networkName + ".org",
+			NetworkInterface: networkName,
+			PidFile:          makePath(networkName, pidFileName),
+		}
+		if err := conf.save(); err != nil {
+			t.Fatalf("Can't save options: %v", err)
+		}
+		configs = append(configs, conf)
+	}
+	if err := ioutil.WriteFile(configs[0].ConfigFile, []byte("stale config\n"), 0700); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if err := checkForDNSMasqConfFile(configs[1]); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	oldTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(configs[1].ConfigFile, oldTime, oldTime); err != nil {
+		t.Fatalf("Can't change file time: %v", err)
+	}
+	if err := regenerateConfigs(); err != nil {
+		t.Fatalf("Can't regenerate configs: %v", err)
+	}
+	for _, conf := range configs {
+		expected, err := generateDNSMasqConfig(conf)
+		if err != nil {
+			t.Fatalf("Can't generate config: %v", err)
+		}
+		data, err := ioutil.ReadFile(conf.ConfigFile)
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if string(data) != string(expected) {
+			t.Errorf("Wrong config, got: %v, want: %v", string(data), string(expected))
+		}
+	}
+	info, err := os.Stat(configs[1].ConfigFile)
+	if err != nil {
+		t.Fatalf("Can't stat file: %v", err)
+	}
+	if !info.ModTime().Equal(oldTime) {
+		t.Error("Matching config should not be rewritten")
+	}
+}
+
+func TestGC(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	fake := newFakeIPTables(t)
+	var configs []dnsNameFile
+	for _, networkName := range []string{"net1", "net2"} {
+		if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), networkName), 0700); err != nil {
+			t.Fatalf("Can't create network dir: %v", err)
+		}
+		conf := dnsNameFile{
+			AddOnHostsFile:   makePath(networkName, hostsFileName),
+			ConfigFile:       makePath(networkName, confFileName),
+			Domain:           networkName + ".org",
+			NetworkInterface: "cni-" + networkName,
+			PidFile:          makePath(networkName, pidFileName),
+		}
+		if err := conf.save(); err != nil {
+			t.Fatalf("Can't save options: %v", err)
+		}
+		if err := addIPTablesChain(conf.NetworkInterface, conf.port(), false, ipTablesPlacement{}); err != nil {
+			t.Fatalf("Can't add iptables rules: %v", err)
+		}
+		configs = append(configs, conf)
+	}
+	// the process with the config file of the orphaned network in the command
+	// line stands for its dnsmasq instance
+	cmd := exec.Command("sh", "-c", "while :; do sleep 0.1; done", "dnsmasq",
+		"--conf-file="+configs[1].ConfigFile)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Can't start process: %v", err)
+	}
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	if err := ioutil.WriteFile(configs[1].PidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+
+	if err := gc([]string{"cni-net1"}); err != nil {
+		t.Fatalf("Can't collect networks: %v", err)
+	}
+	if _, err := loadDNSMasqFile("net1"); err != nil {
+		t.Errorf("Known network should be kept: %v", err)
+	}
+	if exists, err := hasIPTablesChain("cni-net1", defaultDNSPort, false, ipTablesPlacement{}); err != nil || !exists {
+		t.Errorf("Rules of the known network should be kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(configs[1].PidFile)); !os.IsNotExist(err) {
+		t.Error("Orphaned network dir should be removed")
+	}
+	if exists, err := hasIPTablesChain("cni-net2", defaultDNSPort, false, ipTablesPlacement{}); err != nil || exists {
+		t.Errorf("Rules of the orphaned network should be removed: %v", err)
+	}
+	if len(fake.rules) != 2 {
+		t.Errorf("Wrong number of rules left: %d", len(fake.rules))
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.Sys().(syscall.WaitStatus).Signal() != syscall.SIGTERM {
+			t.Errorf("Instance should be terminated by SIGTERM: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Instance of the orphaned network should be terminated")
+	}
+}
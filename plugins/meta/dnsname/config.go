@@ -19,40 +19,214 @@ const (
 	localServersConfFileName = "localservers.conf"
 	// ownServersConfFileName is the name of the additional dnsmasq config with own servers
 	ownServersConfFileName = "ownservers.conf"
+	// interfaceFileName is the name of the file recording the network interface
+	interfaceFileName = "interface"
+	// optionsFileName is the name of the file storing the dnsmasq instance options
+	optionsFileName = "options.json"
+	// quiescedFileName is the name of the marker file of the quiesced dnsmasq instance
+	quiescedFileName = "quiesced"
+	// queryLogFileName is the name of the per-network dnsmasq log file
+	queryLogFileName = "dnsmasq.log"
+	// resolvConfFileName is the name of the resolv.conf rendered for the containers
+	resolvConfFileName = "resolv.conf"
+	// hupStampFileName is the name of the file recording the latest sighup request
+	hupStampFileName = "hup.pending"
+)
+
+const (
+	// entryFormatAddnHosts writes pod entries into the addn-hosts file
+	entryFormatAddnHosts = "addn-hosts"
+	// entryFormatHostRecord writes pod entries as host-record lines into the local servers config
+	entryFormatHostRecord = "host-record"
+)
+
+// defaultFileMode is the mode of the generated config and hosts files
+const defaultFileMode os.FileMode = 0644
+
+// defaultResolvConfNdots is the ndots option of the rendered resolv.conf if not configured
+const defaultResolvConfNdots = 1
+
+// maxResolvConfNdots is the largest ndots option the resolver accepts
+const maxResolvConfNdots = 15
+
+// defaultExceptInterfaces are the interfaces dnsmasq doesn't listen on if not configured
+var defaultExceptInterfaces = []string{"lo"}
+
+// configHeaderPrefix starts the header line of the dnsmasq config with the checksum
+const configHeaderPrefix = "## dnsname"
+
+// defaultDNSPort is the DNS port dnsmasq listens on if not configured
+const defaultDNSPort = 53
+
+const (
+	// outOfSubnetReject rejects the pod with addresses out of the network subnet
+	outOfSubnetReject = "reject"
+	// outOfSubnetSkip skips the pod addresses out of the network subnet
+	outOfSubnetSkip = "skip"
+)
+
+const (
+	// forwardingAllServers queries all upstream servers in parallel
+	forwardingAllServers = "all-servers"
+	// forwardingStrictOrder queries upstream servers in the configured order
+	forwardingStrictOrder = "strict-order"
+	// forwardingDefault leaves the upstream server selection to dnsmasq
+	forwardingDefault = "default"
+)
+
+const (
+	// firewallIPTables accepts the DNS queries with iptables rules
+	firewallIPTables = "iptables"
+	// firewallNFTables accepts the DNS queries with nftables rules
+	firewallNFTables = "nftables"
+)
+
+const (
+	// bindModeDynamic binds dnsmasq with bind-dynamic following the interface addresses
+	bindModeDynamic = "dynamic"
+	// bindModeInterfaces binds dnsmasq with bind-interfaces to the addresses at startup
+	bindModeInterfaces = "interfaces"
 )
 
 const dnsMasqTemplate = `## WARNING: THIS IS AN AUTOGENERATED FILE
 ## AND SHOULD NOT BE EDITED MANUALLY AS IT
 ## LIKELY TO AUTOMATICALLY BE REPLACED.
-all-servers
-strict-order
-local=/{{.Domain}}/
-domain={{.Domain}}
-expand-hosts
-pid-file={{.PidFile}}
-except-interface=lo
-bind-dynamic
-no-hosts
-interface={{.NetworkInterface}}
+{{if or (eq .Forwarding "") (eq .Forwarding "all-servers")}}all-servers
+{{end}}{{if or (eq .Forwarding "") (eq .Forwarding "strict-order")}}strict-order
+{{end}}{{range .LocalDomains}}local=/{{.}}/
+{{end}}{{range .ReverseZones}}local=/{{.}}/
+{{end}}domain={{.Domain}}
+{{if not .DisableExpandHosts}}expand-hosts
+{{end}}pid-file={{.PidFile}}{{if .DNSPort}}
+port={{.DNSPort}}{{end}}{{if .CacheSize}}
+cache-size={{.CacheSize}}{{end}}{{if .NoNegcache}}
+no-negcache{{else if .NegTTL}}
+neg-ttl={{.NegTTL}}{{end}}
+{{range .ExceptInterfaces}}except-interface={{.}}
+{{end}}{{if eq .BindMode "interfaces"}}bind-interfaces{{else}}bind-dynamic{{end}}{{range .ListenAddressesV4}}
+listen-address={{.}}{{end}}{{range .ListenAddressesV6}}
+listen-address={{.}}{{end}}
+{{if not .UseHostsFile}}no-hosts
+{{end}}interface={{.NetworkInterface}}
 addn-hosts={{.AddOnHostsFile}}
-conf-file={{.LocalServersConfFile}}`
+conf-file={{.LocalServersConfFile}}{{if .ResolvFile}}
+resolv-file={{.ResolvFile}}{{end}}{{range .Nameservers}}
+server={{.}}{{end}}{{range $name, $iface := .InterfaceNames}}
+interface-name={{$name}},{{$iface}}{{end}}{{range .Wildcards}}
+address=/{{.Domain}}/{{.IP}}{{end}}{{if .LogFile}}
+log-facility={{.LogFile}}{{end}}{{if .FilterAAAA}}
+filter-AAAA{{end}}{{if .FilterANY}}
+filter-rr=ANY{{end}}{{if .AddSubnet}}
+add-subnet={{.AddSubnet}}{{end}}{{if .DNSLoopDetect}}
+dns-loop-detect{{end}}{{if .LocalService}}
+local-service{{end}}{{if .LogQueries}}
+log-queries{{end}}{{range .ExtraOptions}}
+{{.}}{{end}}`
 
 var (
 	// ErrBinaryNotFound means that the dnsmasq binary was not found
 	ErrBinaryNotFound = errors.New("unable to locate dnsmasq in path")
+	// ErrBinaryNotExecutable means that the dnsmasq binary exists but can't be executed
+	ErrBinaryNotExecutable = errors.New("dnsmasq binary is not executable")
 	// ErrNoIPAddressFound means that CNI was unable to resolve an IP address in the CNI configuration
 	ErrNoIPAddressFound = errors.New("no ip address was found in the network")
+	// ErrInterfaceInUse means that the network interface is already used by another network
+	ErrInterfaceInUse = errors.New("network interface is already used by another network")
+	// ErrForeignDNSMasq means that a DNS server not managed by the plugin serves the network interface
+	ErrForeignDNSMasq = errors.New("DNS server not managed by the plugin is detected")
+	// ErrDNSPortInUse means that the DNS port is bound by another process on the network interface
+	ErrDNSPortInUse = errors.New("DNS port is already in use, configure a free dnsPort")
+	// ErrFirewallUnavailable means that the firewall backend can't be used on the node
+	ErrFirewallUnavailable = errors.New("firewall is not available, check the iptables or nftables installation and the plugin privileges")
+	// ErrDNSMasqNotRunning means that the pid file of the dnsmasq instance is missing or stale
+	ErrDNSMasqNotRunning = errors.New("dnsmasq instance is not running")
+	// ErrLockTimeout means that the lock wasn't acquired before the timeout expired
+	ErrLockTimeout = errors.New("timed out waiting for the lock")
+	// ErrHostExists means that the pod name is already used by another entry of the network
+	ErrHostExists = errors.New("host already exists")
+	// ErrAliasExists means that the pod alias is already used by another entry of the network
+	ErrAliasExists = errors.New("alias already exists")
 )
 
 // DNSNameConf represents the cni config with the domain name attribute
 type DNSNameConf struct {
 	types.NetConf
-	DomainName    string   `json:"domainName"`
-	MultiDomain   bool     `json:"multiDomain"`
-	RemoteServers []string `json:"remoteServers"`
-	RuntimeConfig struct { // The capability arg
-		Aliases map[string][]string `json:"aliases"`
+	DomainName          string            `json:"domainName"`
+	Domains             []string          `json:"domains"`
+	MultiDomain         bool              `json:"multiDomain"`
+	RemoteServers       []string          `json:"remoteServers"`
+	InterfaceNames      map[string]string `json:"interfaceNames"`
+	AbsoluteAliases     []string          `json:"absoluteAliases"`
+	MaxMemoryMB         int               `json:"maxMemoryMB"`
+	ListenAddressesV4   []string          `json:"listenAddressesV4"`
+	ListenAddressesV6   []string          `json:"listenAddressesV6"`
+	PTRRecords          bool              `json:"ptrRecords"`
+	DNSMasqLogFile      string            `json:"dnsmasqLogFile"`
+	PluginLogFile       string            `json:"pluginLogFile"`
+	HostsFileBackups    int               `json:"hostsFileBackups"`
+	FilterAAAA          bool              `json:"filterAAAA"`
+	FilterANY           bool              `json:"filterANY"`
+	AddSubnet           string            `json:"addSubnet"`
+	EntryFormat         string            `json:"entryFormat"`
+	DNSLoopDetect       bool              `json:"dnsLoopDetect"`
+	Forwarding          string            `json:"forwarding"`
+	ValidateHostsFile   bool              `json:"validateHostsFile"`
+	PrimaryIPOnly       bool              `json:"primaryIPOnly"`
+	PersistDir          string            `json:"persistDir"`
+	PersistInterval     int               `json:"persistInterval"`
+	LocalService        bool              `json:"localService"`
+	LogQueries          bool              `json:"logQueries"`
+	MaxLogSizeKB        int               `json:"maxLogSizeKB"`
+	Subnet              string            `json:"subnet"`
+	OutOfSubnet         string            `json:"outOfSubnet"`
+	DisableIPv6Firewall bool              `json:"disableIPv6Firewall"`
+	DisableFirewall     bool              `json:"disableFirewall"`
+	DNSPort             int               `json:"dnsPort"`
+	FileMode            string            `json:"fileMode"`
+	FirewallBackend     string            `json:"firewallBackend"`
+	DetectConfigDrift   bool              `json:"detectConfigDrift"`
+	Nameservers         []string          `json:"nameservers"`
+	ResolvConf          bool              `json:"resolvConf"`
+	BindMode            string            `json:"bindMode"`
+	CacheSize           int               `json:"cacheSize"`
+	NegTTL              int               `json:"negTTL"`
+	NoNegcache          bool              `json:"noNegcache"`
+	ExtraOptions        []string          `json:"extraOptions"`
+	LockTimeout         int               `json:"lockTimeout"`
+	IPTablesTable       string            `json:"iptablesTable"`
+	IPTablesChain       string            `json:"iptablesChain"`
+	IPTablesPosition    int               `json:"iptablesPosition"`
+	IPTablesAppend      bool              `json:"iptablesAppend"`
+	Reverse             bool              `json:"reverse"`
+	Netns               string            `json:"netns"`
+	StartAttempts       int               `json:"startAttempts"`
+	StartRetryDelayMs   int               `json:"startRetryDelayMs"`
+	Wildcards           []WildcardAddress `json:"wildcards"`
+	UseHostsFile        bool              `json:"useHostsFile"`
+	ExceptInterfaces    []string          `json:"exceptInterfaces"`
+	ConfigChecksum      bool              `json:"configChecksum"`
+	ResolvFile          string            `json:"resolvFile"`
+	ReloadDebounceMs    int               `json:"reloadDebounceMs"`
+	DisableExpandHosts  bool              `json:"disableExpandHosts"`
+	Ndots               int               `json:"ndots"`
+	RuntimeConfig       struct {          // The capability arg
+		Aliases     map[string][]string `json:"aliases"`
+		StaticHosts []StaticHost        `json:"staticHosts"`
 	} `json:"runtimeConfig,omitempty"`
+	Args podname `json:"-"`
+}
+
+// StaticHost is a fixed host entry of the network not backed by a pod
+type StaticHost struct {
+	Name    string   `json:"name"`
+	IP      string   `json:"ip"`
+	Aliases []string `json:"aliases"`
+}
+
+// WildcardAddress resolves every name under the subdomain of the network to the IP
+type WildcardAddress struct {
+	Domain string `json:"domain"`
+	IP     string `json:"ip"`
 }
 
 // dnsNameFile describes the plugin's attributes
@@ -61,14 +235,84 @@ type dnsNameFile struct {
 	Binary               string
 	ConfigFile           string
 	Domain               string
+	Domains              []string
 	NetworkInterface     string
 	PidFile              string
 	LocalServersConfFile string
 	OwnServersConfFile   string
+	InterfaceFile        string
+	InterfaceNames       map[string]string
+	MaxMemoryMB          int
+	ListenAddressesV4    []string
+	ListenAddressesV6    []string
+	PTRRecords           bool
+	LogFile              string
+	HostsFileBackups     int
+	FilterAAAA           bool
+	FilterANY            bool
+	AddSubnet            string
+	EntryFormat          string
+	DNSLoopDetect        bool
+	Forwarding           string
+	ValidateHostsFile    bool
+	PrimaryIPOnly        bool
+	PersistDir           string
+	PersistInterval      int
+	LocalService         bool
+	LogQueries           bool
+	MaxLogSizeKB         int
+	Subnet               string
+	OutOfSubnet          string
+	DisableIPv6Firewall  bool
+	DisableFirewall      bool
+	DNSPort              int
+	FileMode             os.FileMode
+	FirewallBackend      string
+	DetectConfigDrift    bool
+	Nameservers          []string
+	ResolvConfFile       string
+	BindMode             string
+	CacheSize            int
+	NegTTL               int
+	NoNegcache           bool
+	ExtraOptions         []string
+	IPTablesPlacement    ipTablesPlacement
+	Reverse              bool
+	Netns                string
+	StartAttempts        int
+	StartRetryDelayMs    int
+	Wildcards            []WildcardAddress
+	UseHostsFile         bool
+	ExceptInterfaces     []string
+	ConfigChecksum       bool
+	ResolvFile           string
+	ReloadDebounceMs     int
+	DisableExpandHosts   bool
+	Ndots                int
+	// dryRun collects the artifacts instead of applying them if set
+	dryRun *dryRunArtifacts
 }
 
+// netnsDir is the directory of the named network namespaces
+const netnsDir = "/var/run/netns"
+
+// confDirEnv is the environment variable overriding the configuration directory
+const confDirEnv = "DNSNAME_CONF_DIR"
+
+// confDir is the configuration directory, it is resolved once at startup so
+// all files of the invocation are kept in the same directory
+var confDir = resolveConfDir()
+
 // dnsNameConfPath tells where we store the conf, pid, and hosts files
 func dnsNameConfPath() string {
+	return confDir
+}
+
+// resolveConfDir returns the configuration directory from the environment
+func resolveConfDir() string {
+	if confDir := os.Getenv(confDirEnv); confDir != "" {
+		return confDir
+	}
 	xdgRuntimeDir := os.Getenv("XDG_RUNTIME_DIR")
 	if xdgRuntimeDir != "" {
 		return filepath.Join(xdgRuntimeDir, "containers/cni/dnsname")
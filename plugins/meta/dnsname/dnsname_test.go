@@ -126,8 +126,8 @@ var _ = Describe("dnsname tests", func() {
 
 			files, err = ioutil.ReadDir(filepath.Join(dnsNameConfPath(), "test"))
 			Expect(err).To(BeNil())
-			expectedFileNames := []string{hostsFileName, confFileName, localServersConfFileName,
-				ownServersConfFileName, pidFileName}
+			expectedFileNames := []string{hostsFileName, confFileName, interfaceFileName, localServersConfFileName,
+				"lock", optionsFileName, ownServersConfFileName, pidFileName}
 			resultingFileNames = nil
 			for _, f := range files {
 				resultingFileNames = append(resultingFileNames, f.Name())
@@ -3,157 +3,1564 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
+	"unicode"
 
-	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
-	"github.com/coreos/go-iptables/iptables"
+	"github.com/alexflint/go-filemutex"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
+	"golang.org/x/sys/unix"
 )
 
-var chainArgs = []string{"-p", "udp", "-m", "udp", "--dport", "53", "-j", "ACCEPT"}
+// maxInterfaceNameLength is the maximum length of the Linux interface name
+const maxInterfaceNameLength = unix.IFNAMSIZ - 1
 
-// dnsNameLock embeds the CNI disk lock so we can hang methods from it
+// avgHostsLineLength is the estimated average length of the hosts file line
+const avgHostsLineLength = 32
+
+// reservationMarker starts the hosts file line reserving a name without IP
+const reservationMarker = "#reserved"
+
+const (
+	// staticHostsBegin starts the hosts file section of the static entries
+	staticHostsBegin = "# BEGIN dnsname static hosts"
+	// staticHostsEnd ends the hosts file section of the static entries
+	staticHostsEnd = "# END dnsname static hosts"
+)
+
+// PodEntry describes the DNS records of a pod
+type PodEntry struct {
+	Name    string
+	Aliases []string
+	IPs     []*net.IPNet
+	// TTL if set, the entry is written as host-record with the TTL
+	TTL int
+}
+
+// lockPollInterval is the interval of the lock attempts with a timeout
+var lockPollInterval = 10 * time.Millisecond
+
+// dnsNameLock embeds the file mutex so we can hang methods from it
 type dnsNameLock struct {
-	lock *disk.FileLock
+	lock *filemutex.FileMutex
+}
+
+// release unlocks and closes the disk lock.
+func (m *dnsNameLock) release() error {
+	if err := m.lock.Unlock(); err != nil {
+		return err
+	}
+	return m.lock.Close()
+}
+
+// acquire locks the disk lock.
+func (m *dnsNameLock) acquire() error {
+	return m.lock.Lock()
+}
+
+// acquireWithTimeout attempts to lock the disk lock until the timeout expires,
+// so a wedged holder makes the plugin fail instead of hanging. A zero timeout
+// blocks until the lock is acquired as acquire does.
+func (m *dnsNameLock) acquireWithTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return m.acquire()
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := m.lock.TryLock()
+		if err != filemutex.AlreadyLocked {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(ErrLockTimeout, "waited %s", timeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// getLock returns a dnsNameLock synchronizing the configuration directory for
+// the domain. The lock file of a directory is the lock file in it.
+func getLock(path string) (*dnsNameLock, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		path = filepath.Join(path, "lock")
+	}
+	l, err := filemutex.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsNameLock{l}, nil
+}
+
+// lockHostsFile acquires the lock of the network directory of the hosts file.
+// It serializes the read-check-then-write sequences on the hosts file, so the
+// concurrent invocations don't produce duplicated or garbled lines.
+func lockHostsFile(path string) (*dnsNameLock, error) {
+	lock, err := getLock(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	if err := lock.acquire(); err != nil {
+		lock.lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// dryRunArtifacts collects the artifacts the network setup would produce, so
+// the configuration can be validated without writing the files and changing
+// the firewall
+type dryRunArtifacts struct {
+	Config        string     `json:"config"`
+	HostsLines    []string   `json:"hostsLines"`
+	FirewallRules [][]string `json:"firewallRules"`
+}
+
+// withDryRun returns the copy of the options collecting the artifacts into the
+// returned dryRunArtifacts instead of applying them
+func (d dnsNameFile) withDryRun() (dnsNameFile, *dryRunArtifacts) {
+	d.dryRun = &dryRunArtifacts{}
+	return d, d.dryRun
+}
+
+// dryRunNetwork renders the dnsmasq config, the hosts file lines of the entry
+// and the firewall rules of the network without touching the system
+func dryRunNetwork(conf dnsNameFile, entry PodEntry) (*dryRunArtifacts, error) {
+	d, artifacts := conf.withDryRun()
+	if err := checkForDNSMasqConfFile(d); err != nil {
+		return nil, err
+	}
+	ips, err := d.subnetIPs(entry.Name, entry.IPs)
+	if err != nil {
+		return nil, err
+	}
+	entry.IPs = ips
+	if d.PrimaryIPOnly {
+		entry.IPs = primaryIPs(entry.IPs)
+	}
+	if err := d.appendToHostsFile(entry); err != nil {
+		return nil, err
+	}
+	if err := d.firewall().ensureAllow(d.NetworkInterface, d.port()); err != nil {
+		return nil, err
+	}
+	return artifacts, nil
+}
+
+// checkFromDNSMasqConfFile ensures that the dnsmasq conf file for
+// the network interface exists or it creates it. With DetectConfigDrift the
+// existing file is also compared with the generated one and rewritten, with the
+// running instance restarted, if the configuration has changed.
+func checkForDNSMasqConfFile(conf dnsNameFile) error {
+	if conf.dryRun != nil {
+		newConfig, err := generateDNSMasqConfig(conf)
+		if err != nil {
+			return err
+		}
+		conf.dryRun.Config = string(newConfig)
+		return nil
+	}
+	if _, err := os.Stat(conf.ConfigFile); err == nil {
+		if conf.DetectConfigDrift {
+			return regenerateConfig(conf)
+		}
+		// the file already exists, we can proceed
+		return err
+	}
+	newConfig, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		return err
+	}
+	// Generate the template and compile it. The config is swapped in, so
+	// dnsmasq and concurrent invocations never read a partially written one.
+	return writeFileAtomic(conf.ConfigFile, newConfig, conf.fileMode())
+}
+
+// renameFileAtomic renames the written temporary file, it is replaced in tests
+var renameFileAtomic = os.Rename
+
+// writeFileAtomic writes the file content into a temporary file in the same
+// directory, so it is on the same filesystem, and renames it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := renameFileAtomic(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// generateDNSMasqConfig fills out the configuration file template for the dnsmasq service
+func generateDNSMasqConfig(config dnsNameFile) ([]byte, error) {
+	var buf bytes.Buffer
+	if config.Domain == "" && len(config.Domains) > 0 {
+		config.Domain = config.Domains[0]
+	}
+	// dnsmasq expects the internationalized domains in the ASCII form
+	domain, err := asciiDomain(config.Domain)
+	if err != nil {
+		return nil, err
+	}
+	config.Domain = domain
+	domains := make([]string, 0, len(config.Domains))
+	for _, domain := range config.Domains {
+		domain, err := asciiDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	config.Domains = domains
+	for _, domain := range config.LocalDomains() {
+		if err := validateDomain(domain); err != nil {
+			return nil, err
+		}
+	}
+	wildcards, err := asciiWildcards(config.Wildcards)
+	if err != nil {
+		return nil, err
+	}
+	config.Wildcards = wildcards
+	if err := config.validateWildcards(); err != nil {
+		return nil, err
+	}
+	if err := validateInterfaceNames(config.InterfaceNames); err != nil {
+		return nil, err
+	}
+	if len(config.ExceptInterfaces) == 0 {
+		config.ExceptInterfaces = defaultExceptInterfaces
+	}
+	if err := validateExceptInterfaces(config.ExceptInterfaces); err != nil {
+		return nil, err
+	}
+	if err := validateListenAddresses(config.ListenAddressesV4, false); err != nil {
+		return nil, err
+	}
+	if err := validateListenAddresses(config.ListenAddressesV6, true); err != nil {
+		return nil, err
+	}
+	if err := validateAddSubnet(config.AddSubnet); err != nil {
+		return nil, err
+	}
+	if err := validateNameservers(config.Nameservers); err != nil {
+		return nil, err
+	}
+	if config.LogFile != "" && !filepath.IsAbs(config.LogFile) {
+		return nil, errors.Errorf("log file %q is not an absolute path", config.LogFile)
+	}
+	if config.ResolvFile != "" && !filepath.IsAbs(config.ResolvFile) {
+		return nil, errors.Errorf("resolv file %q is not an absolute path", config.ResolvFile)
+	}
+	if err := validateExtraOptions(config.ExtraOptions); err != nil {
+		return nil, err
+	}
+	if config.CacheSize < 0 {
+		return nil, errors.Errorf("invalid cache size %d", config.CacheSize)
+	}
+	if config.NegTTL < 0 {
+		return nil, errors.Errorf("invalid negative TTL %d", config.NegTTL)
+	}
+	if config.NegTTL > 0 && config.NoNegcache {
+		return nil, errors.Errorf("negative TTL can't be set with negative caching disabled")
+	}
+	switch config.BindMode {
+	case "", bindModeDynamic, bindModeInterfaces:
+	default:
+		return nil, errors.Errorf("invalid bind mode %q", config.BindMode)
+	}
+	templ, err := template.New("dnsmasq-conf-file").Parse(dnsMasqTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if err := templ.Execute(&buf, config); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	if config.ConfigChecksum {
+		return addConfigHeader(buf.Bytes()), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// addConfigHeader prepends the header line with the plugin version, the
+// generation time and the checksum of the config body
+func addConfigHeader(body []byte) []byte {
+	sum := sha256.Sum256(body)
+	header := fmt.Sprintf("%s %s generated %s sha256:%x\n", configHeaderPrefix, bv.BuildVersion, time.Now().UTC().Format(time.RFC3339), sum)
+	return append([]byte(header), body...)
+}
+
+// splitConfigHeader returns the checksum of the config header and the config
+// body, the checksum is empty if the config has no header
+func splitConfigHeader(config []byte) (string, []byte) {
+	if !bytes.HasPrefix(config, []byte(configHeaderPrefix+" ")) {
+		return "", config
+	}
+	header, body := config, []byte(nil)
+	if i := bytes.IndexByte(config, '\n'); i >= 0 {
+		header, body = config[:i], config[i+1:]
+	}
+	fields := strings.Fields(string(header))
+	return strings.TrimPrefix(fields[len(fields)-1], "sha256:"), body
+}
+
+// configWasModified checks whether the config at path was edited after the
+// plugin wrote it. Only the config with the checksum header can be checked,
+// the config without it is reported as not modified.
+func configWasModified(path string) (bool, error) {
+	config, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	checksum, body := splitConfigHeader(config)
+	if checksum == "" {
+		return false, nil
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(body)) != checksum, nil
+}
+
+// generateResolvConf renders the resolv.conf pointing the containers at the
+// dnsmasq instance, names with fewer dots than ndots are tried with the search
+// domains first
+func generateResolvConf(nameserver net.IP, searchDomains []string, ndots int) ([]byte, error) {
+	if nameserver == nil || nameserver.IsUnspecified() {
+		return nil, errors.Errorf("invalid nameserver %q", nameserver)
+	}
+	asciiDomains := make([]string, 0, len(searchDomains))
+	for _, domain := range searchDomains {
+		domain, err := asciiDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateDomain(domain); err != nil {
+			return nil, err
+		}
+		asciiDomains = append(asciiDomains, domain)
+	}
+	searchDomains = asciiDomains
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "nameserver %s\n", nameserver)
+	if len(searchDomains) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(searchDomains, " "))
+	}
+	fmt.Fprintf(&buf, "options ndots:%d\n", ndots)
+	return buf.Bytes(), nil
+}
+
+// writeResolvConf writes the resolv.conf of the network if configured, the
+// first of the network interface addresses is the nameserver
+func (d dnsNameFile) writeResolvConf(nameservers []string) error {
+	if d.ResolvConfFile == "" {
+		return nil
+	}
+	if len(nameservers) == 0 {
+		return ErrNoIPAddressFound
+	}
+	var searchDomains []string
+	if d.Domain != "" {
+		searchDomains = d.LocalDomains()
+	}
+	ndots := d.Ndots
+	if ndots == 0 {
+		ndots = defaultResolvConfNdots
+	}
+	content, err := generateResolvConf(net.ParseIP(nameservers[0]), searchDomains, ndots)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(d.ResolvConfFile, content, d.fileMode())
+}
+
+// verifyDNSMasqConfig checks that the dnsmasq conf file matches the configuration
+// generated for the current parameters. Comment lines are ignored.
+func verifyDNSMasqConfig(conf dnsNameFile) error {
+	if conf.ConfigChecksum {
+		modified, err := configWasModified(conf.ConfigFile)
+		if err != nil {
+			return err
+		}
+		if modified {
+			return errors.Errorf("%s was modified outside of the plugin", conf.ConfigFile)
+		}
+	}
+	expected, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		return err
+	}
+	current, err := ioutil.ReadFile(conf.ConfigFile)
+	if err != nil {
+		return err
+	}
+	expectedLines, currentLines := configLines(expected), configLines(current)
+	for i := 0; i < len(expectedLines) || i < len(currentLines); i++ {
+		switch {
+		case i >= len(currentLines):
+			return errors.Errorf("%s: missing line %q", conf.ConfigFile, expectedLines[i])
+		case i >= len(expectedLines):
+			return errors.Errorf("%s: unexpected line %q", conf.ConfigFile, currentLines[i])
+		case expectedLines[i] != currentLines[i]:
+			return errors.Errorf("%s: line %q, expected %q", conf.ConfigFile, currentLines[i], expectedLines[i])
+		}
+	}
+	return nil
+}
+
+// configLines returns the dnsmasq configuration lines without comments
+func configLines(config []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(string(config), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// validateInterfaceNames checks that interface-name entries are well formed and
+// refer to existing interfaces
+func validateInterfaceNames(interfaceNames map[string]string) error {
+	for name, iface := range interfaceNames {
+		if name == "" || strings.ContainsAny(name, ",\n\t ") {
+			return errors.Errorf("invalid interface name record %q", name)
+		}
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return errors.Wrapf(err, "interface %q for name %q", iface, name)
+		}
+	}
+	return nil
+}
+
+// validateExceptInterfaces checks that the interfaces excluded from listening
+// are interface names, dnsmasq allows the * wildcard in them
+func validateExceptInterfaces(interfaces []string) error {
+	for _, iface := range interfaces {
+		if err := validateInterfaceName(iface); err != nil {
+			return err
+		}
+		if strings.Contains(iface, ",") {
+			return errors.Errorf("invalid except interface %q", iface)
+		}
+	}
+	return nil
+}
+
+// asciiWildcards returns the wildcard addresses with the subdomains in the
+// ASCII form expected by dnsmasq
+func asciiWildcards(wildcards []WildcardAddress) ([]WildcardAddress, error) {
+	if len(wildcards) == 0 {
+		return nil, nil
+	}
+	converted := make([]WildcardAddress, 0, len(wildcards))
+	for _, wildcard := range wildcards {
+		domain, err := asciiDomain(wildcard.Domain)
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, WildcardAddress{Domain: domain, IP: wildcard.IP})
+	}
+	return converted, nil
+}
+
+// validateWildcards checks that the wildcard addresses are valid IPs and the
+// subdomains are within the domains of the network
+func (d dnsNameFile) validateWildcards() error {
+	for _, wildcard := range d.Wildcards {
+		if net.ParseIP(wildcard.IP) == nil {
+			return errors.Errorf("invalid wildcard address %q of %q", wildcard.IP, wildcard.Domain)
+		}
+		if err := validateHostName(wildcard.Domain); err != nil {
+			return errors.Errorf("invalid wildcard domain %q", wildcard.Domain)
+		}
+		inDomain := false
+		for _, domain := range d.LocalDomains() {
+			if strings.HasSuffix(hostNameKey(wildcard.Domain), "."+hostNameKey(domain)) {
+				inDomain = true
+				break
+			}
+		}
+		if !inDomain {
+			return errors.Errorf("wildcard domain %q is not a subdomain of the network domains", wildcard.Domain)
+		}
+	}
+	return nil
+}
+
+// addPodEntry adds the pod records to the dnsmasq configuration. Returns true
+// if the dnsmasq configuration files are changed and dnsmasq should be restarted.
+func (d dnsNameFile) addPodEntry(entry PodEntry) (bool, error) {
+	ips, err := d.subnetIPs(entry.Name, entry.IPs)
+	if err != nil {
+		return false, err
+	}
+	entry.IPs = ips
+	if d.PrimaryIPOnly {
+		entry.IPs = primaryIPs(entry.IPs)
+	}
+	// dnsmasq doesn't support TTL for addn-hosts entries
+	if entry.TTL > 0 || d.EntryFormat == entryFormatHostRecord {
+		return addHostRecords(d.LocalServersConfFile, entry, d.fileMode())
+	}
+	if !d.PTRRecords && !d.ValidateHostsFile {
+		return false, d.appendToHostsFile(entry)
+	}
+	// forward and reverse records are added both or neither: keep the hosts
+	// file content to roll back the forward records if reverse ones fail or
+	// the updated hosts file is invalid
+	hostsContent, err := ioutil.ReadFile(d.AddOnHostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	hostsExisted := err == nil
+	if err := d.appendToHostsFile(entry); err != nil {
+		return false, err
+	}
+	if d.ValidateHostsFile {
+		if err := validateHostsFile(d.AddOnHostsFile); err != nil {
+			restoreFile(d.AddOnHostsFile, hostsContent, hostsExisted, d.fileMode())
+			return false, err
+		}
+	}
+	if !d.PTRRecords {
+		return false, nil
+	}
+	if err := addPTRRecords(d.LocalServersConfFile, d.ptrTarget(entry.Name), entry.IPs, d.fileMode()); err != nil {
+		restoreFile(d.AddOnHostsFile, hostsContent, hostsExisted, d.fileMode())
+		return false, err
+	}
+	return true, nil
+}
+
+// appendToHostsFile appends the pod entry to the hosts file and applies the
+// configured file mode
+func (d dnsNameFile) appendToHostsFile(entry PodEntry) error {
+	if d.dryRun != nil {
+		ips, err := validIPs(entry.Name, entry.IPs)
+		if err != nil {
+			return err
+		}
+		for _, line := range hostsLines(entry.Name, entry.Aliases, ips) {
+			d.dryRun.HostsLines = append(d.dryRun.HostsLines, strings.TrimSuffix(line, "\n"))
+		}
+		return nil
+	}
+	if err := appendToFile(d.AddOnHostsFile, entry.Name, entry.Aliases, entry.IPs, d.fileMode()); err != nil {
+		return err
+	}
+	return os.Chmod(d.AddOnHostsFile, d.fileMode())
+}
+
+// replaceStaticHosts replaces the static entries section of the hosts file
+// with the given entries, the section is removed if there are none. The pod
+// entries are kept and the new content is swapped in atomically.
+func (d dnsNameFile) replaceStaticHosts(hosts []StaticHost) error {
+	var section []string
+	for _, host := range hosts {
+		ip := net.ParseIP(host.IP)
+		if ip == nil {
+			return errors.Errorf("invalid IP address %q of static host %s", host.IP, host.Name)
+		}
+		for _, name := range append([]string{host.Name}, host.Aliases...) {
+			if err := validateHostName(name); err != nil {
+				return err
+			}
+		}
+		section = append(section, hostsLines(host.Name, host.Aliases, []*net.IPNet{{IP: ip}})...)
+	}
+	lock, err := lockHostsFile(d.AddOnHostsFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", d.AddOnHostsFile, err)
+		}
+	}()
+	content, err := ioutil.ReadFile(d.AddOnHostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var (
+		keepers  []string
+		inStatic bool
+		found    bool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		switch line := strings.TrimSpace(scanner.Text()); {
+		case line == staticHostsBegin:
+			inStatic, found = true, true
+		case line == staticHostsEnd:
+			inStatic = false
+		case !inStatic:
+			keepers = append(keepers, scanner.Text()+"\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !found && len(section) == 0 {
+		return nil
+	}
+	if len(section) > 0 {
+		keepers = append(keepers, staticHostsBegin+"\n")
+		keepers = append(keepers, section...)
+		keepers = append(keepers, staticHostsEnd+"\n")
+	}
+	return writeFileAtomic(d.AddOnHostsFile, []byte(strings.Join(keepers, "")), d.fileMode())
+}
+
+// fileMode returns the mode of the generated config and hosts files
+func (d dnsNameFile) fileMode() os.FileMode {
+	if d.FileMode == 0 {
+		return defaultFileMode
+	}
+	return d.FileMode
+}
+
+// existingFileMode returns the permission bits of the file, or mode if the file
+// doesn't exist
+func existingFileMode(path string, mode os.FileMode) os.FileMode {
+	if info, err := os.Stat(path); err == nil {
+		return info.Mode().Perm()
+	}
+	return mode
+}
+
+// hasPodEntry checks whether the records of the pod exist in the hosts file or,
+// for the host-record entries, in the local servers configuration
+func (d dnsNameFile) hasPodEntry(podname string) (bool, error) {
+	entries, err := readHostEntries(d.AddOnHostsFile)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if hostNameKey(entry.Name) == hostNameKey(podname) {
+			return true, nil
+		}
+	}
+	if d.LocalServersConfFile == "" {
+		return false, nil
+	}
+	items, err := readServerItems(d.LocalServersConfFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, item := range items {
+		if names := hostRecordNames(item); len(names) > 0 && hostNameKey(names[0]) == hostNameKey(podname) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removePodEntry removes the pod records from the dnsmasq configuration. Returns
+// true if there are records left and true if the configuration files are changed.
+func (d dnsNameFile) removePodEntry(podname string) (bool, bool, error) {
+	var serverItems []string
+	if d.PTRRecords {
+		// keep the config to roll back the reverse records if forward ones fail
+		items, err := readServerItems(d.LocalServersConfFile)
+		if err != nil && !os.IsNotExist(err) {
+			return false, false, err
+		}
+		serverItems = items
+	}
+	recordsLeft, confChanged, err := removeHostRecords(d.LocalServersConfFile, podname, d.fileMode())
+	if err != nil {
+		return false, false, err
+	}
+	if d.PTRRecords {
+		removed, err := removePTRRecords(d.LocalServersConfFile, d.ptrTarget(podname), d.fileMode())
+		if err != nil {
+			return false, false, err
+		}
+		confChanged = confChanged || removed
+	}
+	if d.HostsFileBackups > 1 {
+		if err := rotateBackups(d.AddOnHostsFile, d.HostsFileBackups); err != nil {
+			return false, false, err
+		}
+	}
+	shouldHUP, err := removeFromFile(d.AddOnHostsFile, podname)
+	if err != nil {
+		if confChanged && serverItems != nil {
+			if err := writeServerItems(d.LocalServersConfFile, serverItems, d.fileMode()); err != nil {
+				logrus.Errorf("unable to restore %q: %v", d.LocalServersConfFile, err)
+			}
+		}
+		return false, false, err
+	}
+	return shouldHUP || recordsLeft > 0, confChanged, nil
+}
+
+// reloadDNSMasq sends a sighup to the dnsmasq instance of the pid file to reload
+// its hosts files. ErrDNSMasqNotRunning is returned if the pid file is missing
+// or the process is gone, so the caller can start the instance instead.
+func reloadDNSMasq(pidFile string) error {
+	pid, err := dnsNameFile{PidFile: pidFile}.getProcess()
+	if os.IsNotExist(err) {
+		return errors.Wrapf(ErrDNSMasqNotRunning, "pid file %s is missing", pidFile)
+	}
+	if err != nil {
+		return err
+	}
+	if !processAlive(pid.Pid) {
+		return errors.Wrapf(ErrDNSMasqNotRunning, "pid %d of %s is stale", pid.Pid, pidFile)
+	}
+	return pid.Signal(unix.SIGHUP)
+}
+
+// ptrTarget returns the name the reverse records of the pod point to
+func (d dnsNameFile) ptrTarget(podname string) string {
+	if d.Domain == "" || strings.HasSuffix(podname, ".") {
+		return strings.TrimSuffix(podname, ".")
+	}
+	return podname + "." + d.Domain
+}
+
+// restoreFile restores the file content saved before modification with the
+// given mode
+func restoreFile(path string, content []byte, existed bool, mode os.FileMode) {
+	var err error
+	if existed {
+		err = writeFileAtomic(path, content, mode)
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		logrus.Errorf("unable to restore %q: %v", path, err)
+	}
+}
+
+// validateListenAddresses checks that listen addresses are IP addresses of the
+// expected family
+func validateListenAddresses(addresses []string, ipv6 bool) error {
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil || (ip.To4() == nil) != ipv6 {
+			return errors.Errorf("invalid listen address %q", address)
+		}
+	}
+	return nil
+}
+
+// validateNameservers checks that the upstream servers are IP addresses with an
+// optional port in the dnsmasq format <address>[#<port>]
+func validateNameservers(nameservers []string) error {
+	for _, nameserver := range nameservers {
+		address, port := nameserver, ""
+		if i := strings.LastIndex(nameserver, "#"); i >= 0 {
+			address, port = nameserver[:i], nameserver[i+1:]
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return errors.Errorf("invalid nameserver %q", nameserver)
+			}
+		}
+		if net.ParseIP(address) == nil {
+			return errors.Errorf("invalid nameserver %q", nameserver)
+		}
+	}
+	return nil
+}
+
+// validateExtraOptions checks that each of the raw dnsmasq options is a single
+// non empty directive
+func validateExtraOptions(options []string) error {
+	for _, option := range options {
+		if strings.TrimSpace(option) == "" || strings.ContainsAny(option, "\r\n") {
+			return errors.Errorf("invalid dnsmasq option %q", option)
+		}
+	}
+	return nil
+}
+
+// asciiDomain converts the internationalized domain name to the ASCII
+// compatible form (punycode), ASCII domains are returned unchanged
+func asciiDomain(domain string) (string, error) {
+	isASCII := true
+	for _, c := range domain {
+		if c > unicode.MaxASCII {
+			isASCII = false
+			break
+		}
+	}
+	if isASCII {
+		return domain, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid domain name %q", domain)
+	}
+	return ascii, nil
+}
+
+// validateDomain checks the domain name written into the dnsmasq configuration
+// follows the host name rules, so it can't break or extend the configuration
+func validateDomain(domain string) error {
+	if domain == "" {
+		return errors.Errorf("domain name is not set")
+	}
+	if err := validateHostName(domain); err != nil {
+		return errors.Errorf("invalid domain name %q", domain)
+	}
+	return nil
+}
+
+// validateAddSubnet checks the EDNS client subnet specification in the format:
+// [[<IPv4 address>/]<IPv4 prefix length>][,[<IPv6 address>/]<IPv6 prefix length>]
+func validateAddSubnet(addSubnet string) error {
+	if addSubnet == "" {
+		return nil
+	}
+	parts := strings.Split(addSubnet, ",")
+	if len(parts) > 2 {
+		return errors.Errorf("invalid add-subnet %q", addSubnet)
+	}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		ipv6 := i == 1
+		prefix := part
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			ip := net.ParseIP(part[:slash])
+			if ip == nil || (ip.To4() == nil) != ipv6 {
+				return errors.Errorf("invalid add-subnet address %q", part[:slash])
+			}
+			prefix = part[slash+1:]
+		}
+		maxPrefix := 32
+		if ipv6 {
+			maxPrefix = 128
+		}
+		if length, err := strconv.Atoi(prefix); err != nil || length < 0 || length > maxPrefix {
+			return errors.Errorf("invalid add-subnet prefix length %q", prefix)
+		}
+	}
+	return nil
+}
+
+// appendToFile appends a new entry to the dnsmasqs hosts file, the name
+// reservation of the pod if any is replaced by the entry. Invalid addresses are
+// skipped, the entry is rejected only if no valid address is left. Appending
+// the entry already in the file, e.g. on a retried ADD, is a no-op. A new file
+// is created with the given mode.
+func appendToFile(path, podname string, aliases []string, ips []*net.IPNet, mode os.FileMode) error {
+	ips, err := validIPs(podname, ips)
+	if err != nil {
+		return err
+	}
+	// the check of the names and the write must not interleave with other
+	// invocations, the lock covers the whole sequence
+	lock, err := lockHostsFile(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", path, err)
+		}
+	}()
+	if err := repairHostsFile(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logrus.Errorf("failed to close file %q: %v", path, err)
+		}
+	}()
+	// a retried ADD finds the same entry, it is not a collision
+	if same, err := hasSameEntry(f, podname, hostsLines(podname, aliases, ips)); err != nil || same {
+		if same {
+			logrus.Debugf("entry of %s is already in %s", podname, path)
+		}
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reserved, err := checkHostNames(f, podname, aliases)
+	if err != nil {
+		return err
+	}
+	for _, entry := range hostsLines(podname, aliases, ips) {
+		if _, err = f.WriteString(entry); err != nil {
+			return err
+		}
+		logrus.Debugf("appended %s: %s", path, entry)
+	}
+	if reserved {
+		if _, err := removeLinesFromFile(path, podname, nil, isReservation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateFile replaces the lines of the pod in the dnsmasqs hosts file with the
+// entry of the new addresses, e.g. after the pod address has changed. The new
+// content is swapped in atomically, so the pod records are never missing for
+// concurrent readers as with removeFromFile followed by appendToFile.
+func updateFile(path, podname string, aliases []string, ips []*net.IPNet) error {
+	ips, err := validIPs(podname, ips)
+	if err != nil {
+		return err
+	}
+	lock, err := lockHostsFile(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", path, err)
+		}
+	}()
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mode := existingFileMode(path, defaultFileMode)
+	var keepers []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if isHostEntry(fields) && hostNameKey(fields[1]) == hostNameKey(podname) {
+			continue
+		}
+		if isHostEntry(fields) {
+			for _, item := range fields[1:] {
+				for _, alias := range aliases {
+					if hostNameKey(alias) == hostNameKey(item) {
+						return aliasExists(alias)
+					}
+				}
+				if hostNameKey(item) == hostNameKey(podname) {
+					return hostExists(podname)
+				}
+			}
+		}
+		keepers = append(keepers, normalizeHostsLine(scanner.Text(), fields)+"\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	keepers = append(keepers, hostsLines(podname, aliases, ips)...)
+	return writeFileAtomic(path, []byte(strings.Join(keepers, "")), mode)
+}
+
+// nameExistsError reports the collision of the name with another entry, it
+// keeps the message naming the entry and matches ErrHostExists or
+// ErrAliasExists with errors.Is
+type nameExistsError struct {
+	err  error
+	kind string
+	name string
+}
+
+func (e *nameExistsError) Error() string {
+	return fmt.Sprintf("%s %s already exists", e.kind, e.name)
+}
+
+func (e *nameExistsError) Unwrap() error {
+	return e.err
+}
+
+// hostExists returns the ErrHostExists error of the host name
+func hostExists(name string) error {
+	return &nameExistsError{err: ErrHostExists, kind: "Host", name: name}
 }
 
-// release unlocks and closes the disk lock.
-func (m *dnsNameLock) release() error {
-	if err := m.lock.Unlock(); err != nil {
-		return err
-	}
-	return m.lock.Close()
+// aliasExists returns the ErrAliasExists error of the alias
+func aliasExists(alias string) error {
+	return &nameExistsError{err: ErrAliasExists, kind: "Alias", name: alias}
 }
 
-// acquire locks the disk lock.
-func (m *dnsNameLock) acquire() error {
-	return m.lock.Lock()
+// hostsLines formats the hosts file lines of the pod, one per address
+func hostsLines(podname string, aliases []string, ips []*net.IPNet) []string {
+	lines := make([]string, 0, len(ips))
+	for _, ip := range uniqueIPs(ips) {
+		entry := fmt.Sprintf("%s\t%s", ip.IP.String(), podname)
+		for _, alias := range aliases {
+			entry += fmt.Sprintf("\t%s", alias)
+		}
+		lines = append(lines, entry+"\n")
+	}
+	return lines
 }
 
-// getLock returns a dnsNameLock synchronizing the configuration directory for
-// the domain.
-func getLock(path string) (*dnsNameLock, error) {
-	l, err := disk.NewFileLock(path)
+// replaceEntries replaces the entries of the hosts file with the desired set,
+// so reconciling controllers can apply the full set at once. The names and
+// addresses are checked as for ADD since the set comes from a user supplied
+// file. The static entries section, the name reservations not filled by the
+// set and the lines which are not host records are kept. The new content is
+// swapped in atomically. Returns true if the content is changed and the
+// dnsmasq instance should be reloaded.
+func replaceEntries(cfg dnsNameFile, desired []PodEntry) (bool, error) {
+	var records []string
+	names := make(map[string]bool)
+	for _, entry := range desired {
+		for _, name := range append([]string{entry.Name}, entry.Aliases...) {
+			if err := validateHostName(name); err != nil {
+				return false, err
+			}
+			if names[hostNameKey(name)] {
+				return false, errors.Errorf("Host %s is duplicated", name)
+			}
+			names[hostNameKey(name)] = true
+		}
+		ips, err := validIPs(entry.Name, entry.IPs)
+		if err != nil {
+			return false, err
+		}
+		records = append(records, hostsLines(entry.Name, entry.Aliases, ips)...)
+	}
+	lock, err := lockHostsFile(cfg.AddOnHostsFile)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	return &dnsNameLock{l}, nil
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", cfg.AddOnHostsFile, err)
+		}
+	}()
+	oldContent, err := ioutil.ReadFile(cfg.AddOnHostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	existed := err == nil
+	var (
+		keepers  []string
+		static   []string
+		inStatic bool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(oldContent))
+	for scanner.Scan() {
+		// the static entries section is managed by replaceStaticHosts only
+		switch strings.TrimSpace(scanner.Text()) {
+		case staticHostsBegin:
+			inStatic = true
+		case staticHostsEnd:
+			inStatic = false
+			static = append(static, scanner.Text()+"\n")
+			continue
+		}
+		if inStatic {
+			static = append(static, scanner.Text()+"\n")
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if isHostRecord(fields) || isReservation(fields) && names[hostNameKey(fields[1])] {
+			continue
+		}
+		keepers = append(keepers, normalizeHostsLine(scanner.Text(), fields)+"\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	keepers = append(append(keepers, records...), static...)
+	newContent := strings.Join(keepers, "")
+	if existed && string(oldContent) == newContent {
+		return false, nil
+	}
+	if err := writeFileAtomic(cfg.AddOnHostsFile, []byte(newContent), cfg.fileMode()); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// checkFromDNSMasqConfFile ensures that the dnsmasq conf file for
-// the network interface exists or it creates it
-func checkForDNSMasqConfFile(conf dnsNameFile) error {
-	if _, err := os.Stat(conf.ConfigFile); err == nil {
-		// the file already exists, we can proceed
-		return err
+// subnetIPs checks that the pod addresses belong to the network subnet to catch
+// IPAM bugs. The addresses out of the subnet are rejected or skipped with a
+// warning depending on the out of subnet policy.
+func (d dnsNameFile) subnetIPs(podname string, ips []*net.IPNet) ([]*net.IPNet, error) {
+	if d.Subnet == "" {
+		return ips, nil
 	}
-	newConfig, err := generateDNSMasqConfig(conf)
+	_, subnet, err := net.ParseCIDR(d.Subnet)
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "invalid subnet")
+	}
+	inSubnet := make([]*net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		if subnet.Contains(ip.IP) {
+			inSubnet = append(inSubnet, ip)
+			continue
+		}
+		if d.OutOfSubnet != outOfSubnetSkip {
+			return nil, errors.Errorf("address %s of %s is out of subnet %s", ip.IP, podname, d.Subnet)
+		}
+		logrus.Warnf("skipping address %s of %s out of subnet %s", ip.IP, podname, d.Subnet)
+	}
+	if len(inSubnet) == 0 {
+		return nil, errors.Errorf("%s has no address in subnet %s", podname, d.Subnet)
+	}
+	return inSubnet, nil
+}
+
+// primaryIPs returns the first address of each family, so the name resolves to
+// the primary address of the pod only
+func primaryIPs(ips []*net.IPNet) []*net.IPNet {
+	var primaryV4, primaryV6 *net.IPNet
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			if primaryV4 == nil {
+				primaryV4 = ip
+			}
+		} else if primaryV6 == nil {
+			primaryV6 = ip
+		}
+	}
+	primary := make([]*net.IPNet, 0, 2)
+	for _, ip := range []*net.IPNet{primaryV4, primaryV6} {
+		if ip != nil {
+			primary = append(primary, ip)
+		}
+	}
+	return primary
+}
+
+// uniqueIPs removes the duplicated addresses, e.g. returned by two IPAM
+// delegates, keeping the order
+func uniqueIPs(ips []*net.IPNet) []*net.IPNet {
+	unique := make([]*net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		duplicate := false
+		for _, added := range unique {
+			if added.IP.Equal(ip.IP) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			unique = append(unique, ip)
+		}
+	}
+	return unique
+}
+
+// validIPs returns the addresses of the pod without the nil and zero ones, a
+// malformed IPAM result must not write a line rejected by dnsmasq
+func validIPs(podname string, ips []*net.IPNet) ([]*net.IPNet, error) {
+	valid := make([]*net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		if ip == nil || len(ip.IP) == 0 || ip.IP.IsUnspecified() {
+			logrus.Warnf("skipping invalid address %v of pod %s", ip, podname)
+			continue
+		}
+		valid = append(valid, ip)
+	}
+	if len(valid) == 0 {
+		return nil, errors.Errorf("pod %s has no valid address", podname)
 	}
-	// Generate the template and compile it.
-	return ioutil.WriteFile(conf.ConfigFile, newConfig, 0700)
+	return valid, nil
 }
 
-// addIPTablesChain adds dnsmasq iptables chain
-func addIPTablesChain(interfaceName string) error {
-	ip, err := iptables.New()
+// reserveInFile writes a placeholder line reserving the pod name and aliases
+// before the pod IP is known. The placeholder is a comment for dnsmasq, so the
+// name is not served until the reservation is filled by appendToFile. A new
+// file is created with the given mode.
+func reserveInFile(path, podname string, aliases []string, mode os.FileMode) error {
+	// the check of the names and the write must not interleave with other
+	// invocations, the lock covers the whole sequence
+	lock, err := lockHostsFile(path)
 	if err != nil {
 		return err
 	}
-	args := append([]string{"-i", interfaceName}, chainArgs...)
-	exists, err := ip.Exists("filter", "INPUT", args...)
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", path, err)
+		}
+	}()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, mode)
 	if err != nil {
 		return err
 	}
-	if !exists {
-		if err := ip.Insert("filter", "INPUT", 1, args...); err != nil {
-			return err
+	defer func() {
+		if err := f.Close(); err != nil {
+			logrus.Errorf("failed to close file %q: %v", path, err)
 		}
+	}()
+	reserved, err := checkHostNames(f, podname, aliases)
+	if err != nil {
+		return err
+	}
+	if reserved {
+		return errors.Errorf("Host %s is already reserved", podname)
+	}
+	entry := fmt.Sprintf("%s\t%s", reservationMarker, podname)
+	for _, alias := range aliases {
+		entry += fmt.Sprintf("\t%s", alias)
 	}
+	entry += "\n"
+	if _, err = f.WriteString(entry); err != nil {
+		return err
+	}
+	logrus.Debugf("reserved %s: %s", path, entry)
 	return nil
 }
 
-// deleteIPTablesChain deletes dnsmasq iptables chain
-func deleteIPTablesChain(interfaceName string) error {
-	ip, err := iptables.New()
+// releaseInFile removes the name reservation of the pod from the hosts file
+func releaseInFile(path, podname string) error {
+	lock, err := lockHostsFile(path)
 	if err != nil {
 		return err
 	}
-	args := append([]string{"-i", interfaceName}, chainArgs...)
-	return ip.DeleteIfExists("filter", "INPUT", args...)
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", path, err)
+		}
+	}()
+	_, err = removeLinesFromFile(path, podname, nil, isReservation)
+	return err
 }
 
-// generateDNSMasqConfig fills out the configuration file template for the dnsmasq service
-func generateDNSMasqConfig(config dnsNameFile) ([]byte, error) {
-	var buf bytes.Buffer
-	templ, err := template.New("dnsmasq-conf-file").Parse(dnsMasqTemplate)
+// repairHostsFile drops the corrupt lines, e.g. left by a crash during a write,
+// from the hosts file as dnsmasq refuses to load it and the name checks are
+// unreliable. A line is corrupt if it has NUL bytes or doesn't start with an
+// IP address. The original content is kept in the .corrupt file. It must
+// be called under the hosts file lock.
+func repairHostsFile(path string) error {
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
-	if err := templ.Execute(&buf, config); err != nil {
-		return nil, err
+	var keepers []string
+	corrupt := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if !isValidHostsLine(scanner.Text()) {
+			logrus.Warnf("dropping malformed line %d of %s: %q", lineNum, path, scanner.Text())
+			corrupt = true
+			continue
+		}
+		keepers = append(keepers, scanner.Text()+"\n")
 	}
-	buf.WriteByte('\n')
-	return buf.Bytes(), nil
-}
-
-// appendToFile appends a new entry to the dnsmasqs hosts file
-func appendToFile(path, podname string, aliases []string, ips []*net.IPNet) error {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !corrupt {
+		return nil
+	}
+	info, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			logrus.Errorf("failed to close file %q: %v", path, err)
+	if err := ioutil.WriteFile(path+".corrupt", content, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(strings.Join(keepers, "")), info.Mode().Perm())
+}
+
+// isValidHostsLine checks if the hosts file line is not corrupt: empty, a
+// comment or starting with an IP address. The lines with the address only are
+// not host records but they are kept as other lines dnsmasq ignores.
+func isValidHostsLine(line string) bool {
+	if strings.ContainsRune(line, 0) {
+		return false
+	}
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	return len(fields) == 0 || net.ParseIP(fields[0]) != nil
+}
+
+// hasSameEntry checks if the host records of the pod in the hosts file are
+// exactly the given lines, regardless of their order and separators
+func hasSameEntry(f *os.File, podname string, lines []string) (bool, error) {
+	want := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		want[strings.TrimSuffix(line, "\n")] = true
+	}
+	found := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if !isHostRecord(fields) || hostNameKey(fields[1]) != hostNameKey(podname) {
+			continue
 		}
-	}()
+		if !want[strings.Join(fields, "\t")] {
+			return false, scanner.Err()
+		}
+		found++
+	}
+	return found > 0 && found == len(want), scanner.Err()
+}
+
+// checkHostNames checks that the pod name and aliases don't collide with the
+// names in the hosts file. The reservation of the pod itself is not a
+// collision, it is reported instead.
+func checkHostNames(f *os.File, podname string, aliases []string) (bool, error) {
+	reserved := false
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		fields := strings.Fields(scanner.Text())
-		if len(fields) > 1 {
+		if isReservation(fields) && hostNameKey(fields[1]) == hostNameKey(podname) {
+			reserved = true
+			continue
+		}
+		// the layout is the same as for removeLinesFromFile: IP address or
+		// reservation marker followed by the host name and aliases
+		if isHostEntry(fields) {
 			for _, item := range fields[1:] {
 				for _, alias := range aliases {
-					if alias == item {
-						return errors.Errorf("Alias %s already exists", alias)
+					if hostNameKey(alias) == hostNameKey(item) {
+						return false, aliasExists(alias)
 					}
 				}
-				if item == podname {
-					return errors.Errorf("Host %s already exists", podname)
+				if hostNameKey(item) == hostNameKey(podname) {
+					return false, hostExists(podname)
 				}
 			}
 		}
 	}
-	for _, ip := range ips {
-		entry := fmt.Sprintf("%s\t%s", ip.IP.String(), podname)
-		for _, alias := range aliases {
-			entry += fmt.Sprintf("\t%s", alias)
+	return reserved, scanner.Err()
+}
+
+// importHostsFile imports the entries of the /etc/hosts format source file into
+// the network hosts file. Entries colliding with the existing ones are skipped.
+// Returns the number of imported entries. A new network hosts file is created
+// with the given mode.
+func importHostsFile(networkHostsPath, sourcePath string, mode os.FileMode) (int, error) {
+	existingNames := make(map[string]bool)
+	if err := scanHostsFile(networkHostsPath, func(fields []string) {
+		for _, name := range fields[1:] {
+			existingNames[hostNameKey(name)] = true
 		}
-		entry += "\n"
-		if _, err = f.WriteString(entry); err != nil {
-			return err
+	}); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	var entries []*PodEntry
+	entriesByName := make(map[string]*PodEntry)
+	if err := scanHostsFile(sourcePath, func(fields []string) {
+		// the same name may have several addresses e.g. IPv4 and IPv6
+		if entry, ok := entriesByName[hostNameKey(fields[1])]; ok {
+			entry.IPs = append(entry.IPs, &net.IPNet{IP: net.ParseIP(fields[0])})
+			return
 		}
-		logrus.Debugf("appended %s: %s", path, entry)
+		entry := &PodEntry{Name: fields[1], Aliases: fields[2:], IPs: []*net.IPNet{{IP: net.ParseIP(fields[0])}}}
+		entriesByName[hostNameKey(entry.Name)] = entry
+		entries = append(entries, entry)
+	}); err != nil {
+		return 0, err
 	}
-	return nil
+	imported := 0
+	for _, entry := range entries {
+		collision := ""
+		for _, name := range append([]string{entry.Name}, entry.Aliases...) {
+			if existingNames[hostNameKey(name)] {
+				collision = name
+				break
+			}
+		}
+		if collision != "" {
+			logrus.Warnf("skipping import of %s: name %s already exists", entry.Name, collision)
+			continue
+		}
+		if err := appendToFile(networkHostsPath, entry.Name, entry.Aliases, entry.IPs, mode); err != nil {
+			return imported, err
+		}
+		for _, name := range append([]string{entry.Name}, entry.Aliases...) {
+			existingNames[hostNameKey(name)] = true
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// validateHostsFile checks that every line of the hosts file can be parsed by
+// dnsmasq, so a malformed entry doesn't break the resolution on reload
+func validateHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !isHostRecord(fields) {
+			return errors.Errorf("invalid host record at line %d of %s", lineNum, path)
+		}
+		for _, name := range fields[1:] {
+			if err := validateHostName(name); err != nil {
+				return errors.Wrapf(err, "invalid host record at line %d of %s", lineNum, path)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// hostEntry is a host record of the hosts file line
+type hostEntry struct {
+	IP      net.IP
+	Name    string
+	Aliases []string
+}
+
+// listEntries returns the host records of the hosts file in the file order,
+// comments and blank lines are skipped. A missing file has no entries.
+func listEntries(path string) ([]hostEntry, error) {
+	var entries []hostEntry
+	err := scanHostsFile(path, func(fields []string) {
+		entries = append(entries, hostEntry{IP: net.ParseIP(fields[0]), Name: fields[1], Aliases: fields[2:]})
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return entries, err
+}
+
+// scanHostsFile calls the handler for the fields of each host record of the
+// hosts file, comments and invalid lines are skipped
+func scanHostsFile(path string, handler func(fields []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !isHostRecord(fields) {
+			logrus.Warnf("skipping invalid line of %s: %q", path, scanner.Text())
+			continue
+		}
+		handler(fields)
+	}
+	return scanner.Err()
+}
+
+// markAbsoluteAliases marks the aliases listed in absolute as fully qualified
+// names with the trailing dot, so they are not expanded with the domain
+func markAbsoluteAliases(aliases, absolute []string) []string {
+	if len(absolute) == 0 {
+		return aliases
+	}
+	marked := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		if stringInSlice(alias, absolute) && !strings.HasSuffix(alias, ".") {
+			alias += "."
+		}
+		marked = append(marked, alias)
+	}
+	return marked
+}
+
+// qualifyName appends domain to the relative host name name
+func qualifyName(name, domain string) string {
+	if name == "" || domain == "" || strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "." + domain
+}
+
+// hostNameKey returns the host name used for comparison: absolute and relative
+// forms of the same name are considered equal, as are names differing in case
+// only since DNS names are case-insensitive
+func hostNameKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// removeLineFromFile removes a given entry and the name reservation from the
+// dnsmasq host file. The lines having any of the given aliases are removed
+// too, so a record can be removed knowing an alias only.
+//
+// The whole file is read and rewritten on every call, so removing a single entry
+// is O(n) and tearing down a network pod by pod is O(n^2) in the number of
+// entries. It is acceptable for the usual network sizes as the rewrite is done
+// with buffered I/O; networks with thousands of pods should be torn down with a
+// single removal of the network directory instead.
+func removeFromFile(path, podname string, aliases ...string) (bool, error) {
+	lock, err := lockHostsFile(path)
+	if os.IsNotExist(err) {
+		// the network directory is already removed
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", path, err)
+		}
+	}()
+	return removeLinesFromFile(path, podname, aliases, isHostEntry)
 }
 
-// removeLineFromFile removes a given entry from the dnsmasq host file
-func removeFromFile(path, podname string) (bool, error) {
+// removeLinesFromFile removes the lines of the pod matching match from the
+// dnsmasq host file. Returns whether host entries are left in the file.
+func removeLinesFromFile(path, podname string, aliases []string, match func(fields []string) bool) (bool, error) {
 	var (
 		keepers []string
 		found   bool
+		mode    = defaultFileMode
 	)
 	shouldHUP := false
-	backup := fmt.Sprintf("%s.old", path)
+	backup, err := reserveBackup(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return shouldHUP, nil
+		}
+		return shouldHUP, err
+	}
 	if err := os.Rename(path, backup); err != nil {
+		os.Remove(backup)
 		if os.IsNotExist(err) {
 			return shouldHUP, nil
 		}
@@ -171,28 +1578,60 @@ func removeFromFile(path, podname string) (bool, error) {
 		}
 	}()
 
+	if info, err := f.Stat(); err == nil {
+		// presize keepers assuming the average entry length
+		keepers = make([]string, 0, info.Size()/avgHostsLineLength+1)
+		mode = info.Mode().Perm()
+	}
 	oldFile := bufio.NewScanner(f)
+	recordsLeft := 0
+	inStatic := false
 	// Iterate the old file
 	for oldFile.Scan() {
+		// the static entries section is managed by replaceStaticHosts only and
+		// doesn't keep the network alive
+		switch strings.TrimSpace(oldFile.Text()) {
+		case staticHostsBegin:
+			inStatic = true
+		case staticHostsEnd:
+			inStatic = false
+			keepers = append(keepers, oldFile.Text()+"\n")
+			continue
+		}
+		if inStatic {
+			keepers = append(keepers, oldFile.Text()+"\n")
+			continue
+		}
 		fields := strings.Fields(oldFile.Text())
-		// if the IP of the entry and the given IP dont match, it should
-		// go into the new file
-		if len(fields) > 1 && fields[1] != podname {
-			keepers = append(keepers, fmt.Sprintf("%s\n", oldFile.Text()))
+		// only matching lines of the pod are removed, everything else including
+		// lines which can't be interpreted as host records goes into the new file
+		if !match(fields) || !hasHostName(fields, podname, aliases) {
+			keepers = append(keepers, normalizeHostsLine(oldFile.Text(), fields)+"\n")
+			if isHostEntry(fields) {
+				recordsLeft++
+			}
 			continue
 		}
 		found = true
 	}
+	if err := oldFile.Err(); err != nil {
+		renameFile(backup, path)
+		return shouldHUP, err
+	}
 	if !found {
 		// We never found a matching record; non-fatal
 		logrus.Debugf("a record for %s was never found in %s", podname, path)
 	}
-	fileLength, err := writeFile(path, keepers)
-	if err != nil {
+	if _, err := writeFile(path, keepers, mode); err != nil {
 		renameFile(backup, path)
 		return shouldHUP, err
 	}
-	if fileLength > 0 {
+	// the rewritten file keeps the mode of the original one
+	if err := os.Chmod(path, mode); err != nil {
+		renameFile(backup, path)
+		return shouldHUP, err
+	}
+	if recordsLeft > 0 {
 		shouldHUP = true
 	}
 	if err := os.Remove(backup); err != nil {
@@ -201,6 +1640,87 @@ func removeFromFile(path, podname string) (bool, error) {
 	return shouldHUP, nil
 }
 
+// reserveBackup creates an empty file with a unique name next to path to be
+// replaced by the backup, so concurrent or interrupted removals never share it
+func reserveBackup(path string) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".old*")
+	if err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// normalizeHostsLine returns the host record line with the fields separated by
+// tabs as appendToFile writes them, other lines are kept verbatim
+func normalizeHostsLine(line string, fields []string) string {
+	if !isHostRecord(fields) {
+		return line
+	}
+	return strings.Join(fields, "\t")
+}
+
+// isHostRecord checks if the hosts file line fields are a host record: IP
+// address followed by host names
+func isHostRecord(fields []string) bool {
+	return len(fields) > 1 && net.ParseIP(fields[0]) != nil
+}
+
+// hasHostName checks if the host record fields have the host name podname or
+// any of the aliases. Names are compared as whole tokens.
+func hasHostName(fields []string, podname string, aliases []string) bool {
+	if podname != "" && hostNameKey(fields[1]) == hostNameKey(podname) {
+		return true
+	}
+	for _, name := range fields[1:] {
+		for _, alias := range aliases {
+			if hostNameKey(name) == hostNameKey(alias) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isReservation checks if the hosts file line fields are a name reservation:
+// the reservation marker followed by host names
+func isReservation(fields []string) bool {
+	return len(fields) > 1 && fields[0] == reservationMarker
+}
+
+// isHostEntry checks if the hosts file line fields are a host record or a name
+// reservation
+func isHostEntry(fields []string) bool {
+	return isHostRecord(fields) || isReservation(fields)
+}
+
+// rotateBackups keeps the current file content as the newest of the numbered
+// backups (path.1, path.2, ...), the backups beyond generations are pruned. The
+// backup has the mode of the file.
+func rotateBackups(path string, generations int) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	mode := existingFileMode(path, defaultFileMode)
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, generations)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := generations - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeFileAtomic(path+".1", content, mode)
+}
+
 // renameFile renames a file to backup
 func renameFile(oldpath, newpath string) {
 	if renameError := os.Rename(oldpath, newpath); renameError != nil {
@@ -208,11 +1728,11 @@ func renameFile(oldpath, newpath string) {
 	}
 }
 
-// writeFile writes a []string to the given path and returns the number
-// of lines in the file
-func writeFile(path string, content []string) (int, error) {
+// writeFile writes a []string to the given path, created with the given mode,
+// and returns the number of lines in the file
+func writeFile(path string, content []string, mode os.FileMode) (int, error) {
 	var counter int
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, mode)
 	if err != nil {
 		return 0, err
 	}
@@ -222,11 +1742,12 @@ func writeFile(path string, content []string) (int, error) {
 		}
 	}()
 
+	writer := bufio.NewWriter(f)
 	for _, line := range content {
-		if _, err := f.WriteString(line); err != nil {
+		if _, err := writer.WriteString(line); err != nil {
 			return 0, err
 		}
 		counter++
 	}
-	return counter, nil
+	return counter, writer.Flush()
 }
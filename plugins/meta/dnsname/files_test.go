@@ -1,13 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
 )
 
 func Test_generateDNSMasqConfig(t *testing.T) {
@@ -76,7 +86,7 @@ func Test_appendToFile(t *testing.T) {
 		t.Fatalf("Can't write initial file: %v", err)
 	}
 	if err := appendToFile(testFile, "pod3", []string{"aliasPod3"},
-		[]*net.IPNet{{IP: net.IP{192, 168, 0, 3}, Mask: nil}}); err != nil {
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 3}, Mask: nil}}, defaultFileMode); err != nil {
 		t.Fatalf("Can't append to file: %v", err)
 	}
 	testResult := `192.168.0.1	pod1	aliasPod1
@@ -88,14 +98,467 @@ func Test_appendToFile(t *testing.T) {
 		t.Fatalf("Can't read file: %v", err)
 	}
 	if string(got) != testResult {
-		t.Errorf("appendToFile() got = '%v', want '%v'", string(got), string(testResult))
+		t.Errorf("appendToFile(, defaultFileMode) got = '%v', want '%v'", string(got), string(testResult))
 	}
 	if err := appendToFile(testFile, "pod", []string{"aliasPod3"},
-		[]*net.IPNet{{IP: net.IP{192, 168, 0, 4}, Mask: nil}}); err == nil {
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 4}, Mask: nil}}, defaultFileMode); err == nil {
 		t.Error("New data should not be appended due to unique host violation")
 	}
 }
 
+func Test_dryRunNetwork(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	origNewIPTables := newIPTables
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		t.Error("iptables should not be invoked in the dry run")
+		return nil, errors.New("dry run")
+	}
+	t.Cleanup(func() { newIPTables = origNewIPTables })
+	conf := dnsNameFile{
+		ConfigFile:       path.Join(tmpDir, confFileName),
+		AddOnHostsFile:   path.Join(tmpDir, hostsFileName),
+		PidFile:          path.Join(tmpDir, pidFileName),
+		Domain:           "foobar.com",
+		NetworkInterface: "cni0",
+	}
+	artifacts, err := dryRunNetwork(conf, PodEntry{Name: "pod1", Aliases: []string{"web"}, IPs: []*net.IPNet{{IP: net.ParseIP("10.88.0.2")}}})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	wantConfig, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if artifacts.Config != string(wantConfig) {
+		t.Errorf("Wrong config: %s", artifacts.Config)
+	}
+	if !reflect.DeepEqual(artifacts.HostsLines, []string{"10.88.0.2\tpod1\tweb"}) {
+		t.Errorf("Wrong hosts lines: %q", artifacts.HostsLines)
+	}
+	wantRules := [][]string{
+		{"iptables", "-t", "filter", "-I", "INPUT", "1", "-i", "cni0", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "ACCEPT"},
+		{"iptables", "-t", "filter", "-I", "INPUT", "1", "-i", "cni0", "-p", "tcp", "-m", "tcp", "--dport", "53", "-j", "ACCEPT"},
+		{"ip6tables", "-t", "filter", "-I", "INPUT", "1", "-i", "cni0", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "ACCEPT"},
+		{"ip6tables", "-t", "filter", "-I", "INPUT", "1", "-i", "cni0", "-p", "tcp", "-m", "tcp", "--dport", "53", "-j", "ACCEPT"},
+	}
+	if !reflect.DeepEqual(artifacts.FirewallRules, wantRules) {
+		t.Errorf("Wrong firewall rules: %q", artifacts.FirewallRules)
+	}
+	items, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Can't read dir: %v", err)
+	}
+	if len(items) != 0 {
+		t.Errorf("Dry run should not create files, got %d", len(items))
+	}
+}
+
+func Test_acquireWithTimeout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	holder, err := getLock(tmpDir)
+	if err != nil {
+		t.Fatalf("Can't get lock: %v", err)
+	}
+	locked := make(chan struct{})
+	unlock := make(chan struct{})
+	go func() {
+		if err := holder.acquire(); err != nil {
+			t.Errorf("Can't acquire lock: %v", err)
+		}
+		close(locked)
+		<-unlock
+		if err := holder.release(); err != nil {
+			t.Errorf("Can't release lock: %v", err)
+		}
+	}()
+	<-locked
+	waiter, err := getLock(tmpDir)
+	if err != nil {
+		t.Fatalf("Can't get lock: %v", err)
+	}
+	start := time.Now()
+	if err := waiter.acquireWithTimeout(50 * time.Millisecond); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("Lock held by another holder should time out, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Lock attempts should last for the timeout, took %s", elapsed)
+	}
+	close(unlock)
+	if err := waiter.acquireWithTimeout(time.Second); err != nil {
+		t.Errorf("Released lock should be acquired: %v", err)
+	}
+	if err := waiter.release(); err != nil {
+		t.Errorf("Can't release lock: %v", err)
+	}
+}
+
+func Test_appendToFileConcurrent(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, hostsFileName)
+	const pods = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, pods)
+	for i := 0; i < pods; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- appendToFile(testFile, fmt.Sprintf("pod%d", i), []string{fmt.Sprintf("alias%d", i)},
+				[]*net.IPNet{{IP: net.IP{10, 0, 0, byte(i + 1)}}}, defaultFileMode)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Can't append to file: %v", err)
+		}
+	}
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(got), "\n"), "\n")
+	if len(lines) != pods {
+		t.Fatalf("Wrong number of lines %d, expected %d", len(lines), pods)
+	}
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		seen[line] = true
+	}
+	for i := 0; i < pods; i++ {
+		line := fmt.Sprintf("10.0.0.%d\tpod%d\talias%d", i+1, i, i)
+		if !seen[line] {
+			t.Errorf("Line %q is missing or garbled", line)
+		}
+	}
+}
+
+func Test_appendToFileInvalidIPs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	if err := appendToFile(testFile, "pod1", nil, []*net.IPNet{nil}, defaultFileMode); err == nil || !strings.Contains(err.Error(), "pod1") {
+		t.Errorf("Nil address should be rejected with the pod name, got: %v", err)
+	}
+	if err := appendToFile(testFile, "pod2", nil, []*net.IPNet{{}, {IP: net.IPv4zero}}, defaultFileMode); err == nil || !strings.Contains(err.Error(), "pod2") {
+		t.Errorf("Zero address should be rejected with the pod name, got: %v", err)
+	}
+	if err := appendToFile(testFile, "pod3", nil, []*net.IPNet{nil, {IP: net.ParseIP("192.168.0.3")}, {}}, defaultFileMode); err != nil {
+		t.Fatalf("Entry with a valid address should be written: %v", err)
+	}
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != "192.168.0.3\tpod3\n" {
+		t.Errorf("appendToFile(, defaultFileMode) got = '%v', want only the valid address", string(got))
+	}
+}
+
+func Test_appendToFileRepairsCorruptFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	// the last write was interrupted
+	initialContent := "192.168.0.1\tpod1\n192.168.0.\x00\x00\n"
+	if err := ioutil.WriteFile(testFile, []byte(initialContent), 0600); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	if err := appendToFile(testFile, "pod2", nil, []*net.IPNet{{IP: net.ParseIP("192.168.0.2")}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	testResult := "192.168.0.1\tpod1\n192.168.0.2\tpod2\n"
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("appendToFile(, defaultFileMode) got = '%v', want '%v'", string(got), testResult)
+	}
+	if info, err := os.Stat(testFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Repaired file should keep the mode: %v", err)
+	}
+	if got, err = ioutil.ReadFile(testFile + ".corrupt"); err != nil || string(got) != initialContent {
+		t.Errorf("Original content should be kept, got = '%v': %v", string(got), err)
+	}
+	if err := validateHostsFile(testFile); err != nil {
+		t.Errorf("Repaired file should be valid: %v", err)
+	}
+}
+
+func Test_appendToFileKeepsAddressOnlyLines(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	if err := ioutil.WriteFile(testFile, []byte("10.0.0.9\n10.0.0.1\tpod1\n"), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	if err := appendToFile(testFile, "pod2", nil, []*net.IPNet{{IP: net.ParseIP("10.0.0.2")}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	testResult := "10.0.0.9\n10.0.0.1\tpod1\n10.0.0.2\tpod2\n"
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("appendToFile(, defaultFileMode) got = '%v', want '%v'", string(got), testResult)
+	}
+	if _, err := os.Stat(testFile + ".corrupt"); !os.IsNotExist(err) {
+		t.Errorf("File with an address only line should not be repaired: %v", err)
+	}
+}
+
+func Test_appendRemoveDualStack(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	if err := appendToFile(testFile, "pod1", nil, []*net.IPNet{{IP: net.ParseIP("192.168.0.1")}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	_, v4, _ := net.ParseCIDR("192.168.0.2/24")
+	v4.IP = net.ParseIP("192.168.0.2")
+	_, v6, _ := net.ParseCIDR("fd00::2/64")
+	v6.IP = net.ParseIP("fd00::2")
+	if err := appendToFile(testFile, "pod2", []string{"web", "db"}, []*net.IPNet{v4, v6}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	testResult := "192.168.0.1\tpod1\n192.168.0.2\tpod2\tweb\tdb\nfd00::2\tpod2\tweb\tdb\n"
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("appendToFile(, defaultFileMode) got = '%v', want '%v'", string(got), testResult)
+	}
+	if _, err := removeFromFile(testFile, "pod2"); err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	if got, err = ioutil.ReadFile(testFile); err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != "192.168.0.1\tpod1\n" {
+		t.Errorf("removeFromFile() should remove both address lines, got = '%v'", string(got))
+	}
+}
+
+func Test_appendToFileCollisions(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	ips := []*net.IPNet{{IP: net.ParseIP("192.168.0.2")}}
+	if err := appendToFile(testFile, "pod1", []string{"alias1"}, ips, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	err = appendToFile(testFile, "pod1", nil, ips, defaultFileMode)
+	if !errors.Is(err, ErrHostExists) || errors.Is(err, ErrAliasExists) {
+		t.Errorf("Host collision should return ErrHostExists, got: %v", err)
+	}
+	if err == nil || err.Error() != "Host pod1 already exists" {
+		t.Errorf("Wrong host collision message: %v", err)
+	}
+	err = appendToFile(testFile, "pod2", []string{"alias1"}, ips, defaultFileMode)
+	if !errors.Is(err, ErrAliasExists) || errors.Is(err, ErrHostExists) {
+		t.Errorf("Alias collision should return ErrAliasExists, got: %v", err)
+	}
+	if err == nil || err.Error() != "Alias alias1 already exists" {
+		t.Errorf("Wrong alias collision message: %v", err)
+	}
+}
+
+func Test_appendToFileCaseInsensitive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	ips := []*net.IPNet{{IP: net.ParseIP("192.168.0.2")}}
+	if err := appendToFile(testFile, "WebApp", []string{"Frontend"}, ips, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	if err := appendToFile(testFile, "webapp", nil, ips, defaultFileMode); !errors.Is(err, ErrHostExists) {
+		t.Errorf("Host differing in case should be a duplicate, got: %v", err)
+	}
+	if err := appendToFile(testFile, "pod2", []string{"FRONTEND"}, []*net.IPNet{{IP: net.ParseIP("192.168.0.3")}}, defaultFileMode); !errors.Is(err, ErrAliasExists) {
+		t.Errorf("Alias differing in case should be a duplicate, got: %v", err)
+	}
+	// the original casing is kept
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != "192.168.0.2\tWebApp\tFrontend\n" {
+		t.Errorf("Wrong file content: %q", string(got))
+	}
+	if _, err := removeFromFile(testFile, "webapp"); err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	if got, err := ioutil.ReadFile(testFile); err != nil || len(got) != 0 {
+		t.Errorf("Entry differing in case should be removed, got: %q, %v", string(got), err)
+	}
+}
+
+func Test_appendToFileRetry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	ips := []*net.IPNet{{IP: net.ParseIP("192.168.0.2")}, {IP: net.ParseIP("fd00::2")}}
+	// fresh insert
+	if err := appendToFile(testFile, "pod1", []string{"alias1"}, ips, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	// the retried ADD succeeds without duplicating the entry
+	if err := appendToFile(testFile, "pod1", []string{"alias1"}, []*net.IPNet{ips[1], ips[0]}, defaultFileMode); err != nil {
+		t.Errorf("Retry with the same entry should succeed: %v", err)
+	}
+	testResult := "192.168.0.2\tpod1\talias1\nfd00::2\tpod1\talias1\n"
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("appendToFile(, defaultFileMode) got = '%v', want '%v'", string(got), testResult)
+	}
+	// the same name with other addresses or aliases is a conflict
+	if err := appendToFile(testFile, "pod1", []string{"alias1"}, []*net.IPNet{{IP: net.ParseIP("192.168.0.3")}}, defaultFileMode); !errors.Is(err, ErrHostExists) {
+		t.Errorf("Conflicting address should return ErrHostExists, got: %v", err)
+	}
+	if err := appendToFile(testFile, "pod1", []string{"alias1"}, ips[:1], defaultFileMode); !errors.Is(err, ErrHostExists) {
+		t.Errorf("Missing address should return ErrHostExists, got: %v", err)
+	}
+	if err := appendToFile(testFile, "pod1", nil, ips, defaultFileMode); !errors.Is(err, ErrHostExists) {
+		t.Errorf("Different aliases should return ErrHostExists, got: %v", err)
+	}
+}
+
+func Test_updateFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	initialContent := `# static entries
+192.168.0.1	pod1	aliasPod1
+fd00::1	pod1	aliasPod1
+192.168.0.2	pod2	aliasPod2
+`
+	if err := ioutil.WriteFile(testFile, []byte(initialContent), 0640); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	renameFileAtomic = func(oldpath, newpath string) error {
+		if _, err := os.Stat(testFile); err != nil {
+			t.Errorf("Hosts file should exist during the update: %v", err)
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	t.Cleanup(func() { renameFileAtomic = os.Rename })
+	if err := updateFile(testFile, "pod1", []string{"aliasPod1"}, []*net.IPNet{{IP: net.ParseIP("192.168.0.5")}}); err != nil {
+		t.Fatalf("Can't update file: %v", err)
+	}
+	testResult := `# static entries
+192.168.0.2	pod2	aliasPod2
+192.168.0.5	pod1	aliasPod1
+`
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("updateFile() got = '%v', want '%v'", string(got), testResult)
+	}
+	if info, err := os.Stat(testFile); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("File mode should be preserved: %v", err)
+	}
+	if err := updateFile(testFile, "pod1", []string{"aliasPod2"}, []*net.IPNet{{IP: net.ParseIP("192.168.0.6")}}); err == nil {
+		t.Error("Alias of another pod should be rejected")
+	}
+}
+
+func Test_listEntries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	entries, err := listEntries(testFile)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Missing file should have no entries, got: %v, %v", entries, err)
+	}
+	content := `# static entries
+
+192.168.0.1	pod1	aliasPod1	web
+fd00::2	pod2
+`
+	if err := ioutil.WriteFile(testFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	entries, err = listEntries(testFile)
+	if err != nil {
+		t.Fatalf("Can't list entries: %v", err)
+	}
+	expected := []hostEntry{
+		{IP: net.ParseIP("192.168.0.1"), Name: "pod1", Aliases: []string{"aliasPod1", "web"}},
+		{IP: net.ParseIP("fd00::2"), Name: "pod2", Aliases: []string{}},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("listEntries() got = %+v, want %+v", entries, expected)
+	}
+}
+
+func Test_appendToFileDuplicatedIP(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	ips := []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}, {IP: net.ParseIP("192.168.0.1")}, {IP: net.ParseIP("fd00::1")}}
+	if err := appendToFile(testFile, "pod1", nil, ips, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	expected := "192.168.0.1\tpod1\nfd00::1\tpod1\n"
+	data, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != expected {
+		t.Errorf("Expected: %s got: %s", expected, string(data))
+	}
+}
+
 func Test_removeFromFile(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "cni_*")
 	if err != nil {
@@ -125,6 +588,1891 @@ func Test_removeFromFile(t *testing.T) {
 		t.Fatalf("Can't read file: %v", err)
 	}
 	if string(got) != testResult {
-		t.Errorf("appendToFile() got = '%v', want '%v'", string(got), string(testResult))
+		t.Errorf("appendToFile(, defaultFileMode) got = '%v', want '%v'", string(got), string(testResult))
+	}
+}
+
+func Test_removeFromFileAliases(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	initialContent := `192.168.0.1	pod1	aliasPod1
+fd00::1	pod1	aliasPod1
+192.168.0.2	pod2	aliasPod2	web
+192.168.0.3	pod3	aliasPod3
+192.168.0.4
+`
+	tests := []struct {
+		name     string
+		podname  string
+		aliases  []string
+		expected string
+	}{
+		{"hostname", "pod1", nil, "192.168.0.2\tpod2\taliasPod2\tweb\n192.168.0.3\tpod3\taliasPod3\n192.168.0.4\n"},
+		{"alias", "", []string{"web"}, "192.168.0.1\tpod1\taliasPod1\nfd00::1\tpod1\taliasPod1\n192.168.0.3\tpod3\taliasPod3\n192.168.0.4\n"},
+		{"no match", "pod", []string{"aliasPod", "we"}, initialContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(testFile, []byte(initialContent), 0644); err != nil {
+				t.Fatalf("Can't write initial file: %v", err)
+			}
+			if _, err := removeFromFile(testFile, tt.podname, tt.aliases...); err != nil {
+				t.Fatalf("Can't remove from file: %v", err)
+			}
+			got, err := ioutil.ReadFile(testFile)
+			if err != nil {
+				t.Fatalf("Can't read file: %v", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("removeFromFile() got = '%v', want '%v'", string(got), tt.expected)
+			}
+		})
+	}
+}
+
+func Test_generateDNSMasqConfigInterfaceNames(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+		InterfaceNames:   map[string]string{"loopback": "lo", "gateway": "lo"},
+	}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if !strings.HasSuffix(string(got), "\ninterface-name=gateway,lo\ninterface-name=loopback,lo\n") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want interface-name lines", string(got))
+	}
+	testConfig.InterfaceNames = map[string]string{"gateway": "nonexistent0"}
+	if _, err := generateDNSMasqConfig(testConfig); err == nil {
+		t.Error("Config with nonexistent interface should not be generated")
+	}
+}
+
+func BenchmarkRemoveFromFile(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		b.Fatalf("Can't create dir: %v", err)
+	}
+	b.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	var content strings.Builder
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&content, "10.%d.%d.%d\tpod%d\taliasPod%d\n", i>>16&0xff, i>>8&0xff, i&0xff, i, i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := ioutil.WriteFile(testFile, []byte(content.String()), 0644); err != nil {
+			b.Fatalf("Can't write initial file: %v", err)
+		}
+		b.StartTimer()
+		if _, err := removeFromFile(testFile, "pod5000"); err != nil {
+			b.Fatalf("Can't remove from file: %v", err)
+		}
+	}
+}
+
+func Test_absoluteAliases(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	aliases := markAbsoluteAliases([]string{"aliasPod1", "db.other.org", "api.other.org."}, []string{"db.other.org"})
+	if err := appendToFile(testFile, "pod1", aliases,
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 1}, Mask: nil}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	if err := appendToFile(testFile, "pod2", []string{"api.other.org"},
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 2}, Mask: nil}}, defaultFileMode); err == nil {
+		t.Error("New data should not be appended due to unique alias violation")
+	}
+	if err := appendToFile(testFile, "pod2", []string{"db.other.org.", "aliasPod2"},
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 2}, Mask: nil}}, defaultFileMode); err == nil {
+		t.Error("New data should not be appended due to unique alias violation")
+	}
+	if err := appendToFile(testFile, "pod2", []string{"aliasPod2"},
+		[]*net.IPNet{{IP: net.IP{192, 168, 0, 2}, Mask: nil}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	testResult := `192.168.0.1	pod1	aliasPod1	db.other.org.	api.other.org.
+192.168.0.2	pod2	aliasPod2
+`
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("appendToFile(, defaultFileMode) got = '%v', want '%v'", string(got), string(testResult))
+	}
+	if _, err := removeFromFile(testFile, "pod1"); err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	testResult = `192.168.0.2	pod2	aliasPod2
+`
+	if got, err = ioutil.ReadFile(testFile); err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("removeFromFile() got = '%v', want '%v'", string(got), string(testResult))
+	}
+}
+
+func Test_generateDNSMasqConfigListenAddresses(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:    makePath("cni0", hostsFileName),
+		ConfigFile:        makePath("cni0", confFileName),
+		Domain:            "foobar.org",
+		NetworkInterface:  "cni0",
+		PidFile:           makePath("cni0", pidFileName),
+		ListenAddressesV4: []string{"10.88.0.1"},
+		ListenAddressesV6: []string{"fd00::1", "fd01::1"},
+	}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if !strings.Contains(string(got),
+		"\nbind-dynamic\nlisten-address=10.88.0.1\nlisten-address=fd00::1\nlisten-address=fd01::1\nno-hosts\n") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want listen-address lines", string(got))
+	}
+	testConfig.ListenAddressesV4 = []string{"fd00::1"}
+	if _, err := generateDNSMasqConfig(testConfig); err == nil {
+		t.Error("Config with IPv6 address in IPv4 listen addresses should not be generated")
+	}
+}
+
+func Test_removeFromFileConcurrentBackups(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	var content strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&content, "192.168.0.%d\tpod%d\n", i+1, i)
+	}
+	if err := ioutil.WriteFile(testFile, []byte(content.String()), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	// the backup left by an interrupted removal is neither reused nor removed
+	staleBackup := testFile + ".old"
+	if err := ioutil.WriteFile(staleBackup, []byte("192.168.0.100\tstale\n"), 0644); err != nil {
+		t.Fatalf("Can't write backup: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := removeFromFile(testFile, fmt.Sprintf("pod%d", i)); err != nil {
+				t.Errorf("Can't remove from file: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	var expected strings.Builder
+	for i := 10; i < 20; i++ {
+		fmt.Fprintf(&expected, "192.168.0.%d\tpod%d\n", i+1, i)
+	}
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != expected.String() {
+		t.Errorf("Wrong file content: %s", string(got))
+	}
+	backups, err := filepath.Glob(testFile + ".old*")
+	if err != nil {
+		t.Fatalf("Can't list backups: %v", err)
+	}
+	if !reflect.DeepEqual(backups, []string{staleBackup}) {
+		t.Errorf("Stray backups are left: %v", backups)
+	}
+}
+
+func Test_removeFromFileKeepsUnknownLines(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	initialContent := `192.168.0.10
+garbage	pod1
+192.168.0.1	pod1	aliasPod1
+192.168.0.2 pod2  aliasPod2  extra
+`
+	if err := ioutil.WriteFile(testFile, []byte(initialContent), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	shouldHUP, err := removeFromFile(testFile, "pod1")
+	if err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	if !shouldHUP {
+		t.Error("Should HUP")
+	}
+	testResult := `192.168.0.10
+garbage	pod1
+192.168.0.2	pod2	aliasPod2	extra
+`
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("removeFromFile() got = '%v', want '%v'", string(got), string(testResult))
+	}
+	// lines which are not host records don't keep the network alive
+	if shouldHUP, err = removeFromFile(testFile, "pod2"); err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	if shouldHUP {
+		t.Error("Should not HUP")
+	}
+}
+
+func Test_appendRemoveFileLayout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	// entries written by an operator or an older version
+	initialContent := "# pod3 is added later\n192.168.0.1 pod1  aliasPod1 \n  192.168.0.2\tpod2\n"
+	if err := ioutil.WriteFile(testFile, []byte(initialContent), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	// names in comments are not taken
+	if err := appendToFile(testFile, "pod3", []string{"aliasPod3"}, []*net.IPNet{{IP: net.ParseIP("192.168.0.3")}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	if err := appendToFile(testFile, "pod4", []string{"aliasPod1"}, []*net.IPNet{{IP: net.ParseIP("192.168.0.4")}}, defaultFileMode); err == nil {
+		t.Error("Alias of the space separated entry should be detected")
+	}
+	if _, err := removeFromFile(testFile, "pod3"); err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	testResult := "# pod3 is added later\n192.168.0.1\tpod1\taliasPod1\n192.168.0.2\tpod2\n"
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("removeFromFile() got = '%v', want '%v'", string(got), testResult)
+	}
+}
+
+func Test_replaceStaticHosts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{AddOnHostsFile: path.Join(tmpDir, "hosts")}
+	add := func(hosts []StaticHost) {
+		if err := conf.replaceStaticHosts(hosts); err != nil {
+			t.Fatalf("Can't replace static hosts: %v", err)
+		}
+		if err := appendToFile(conf.AddOnHostsFile, "pod1", nil, []*net.IPNet{{IP: net.ParseIP("192.168.0.2")}}, defaultFileMode); err != nil {
+			t.Fatalf("Can't append to file: %v", err)
+		}
+	}
+	check := func(want string) {
+		got, err := ioutil.ReadFile(conf.AddOnHostsFile)
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("hosts file got = '%v', want '%v'", string(got), want)
+		}
+	}
+
+	add([]StaticHost{{Name: "gateway", IP: "192.168.0.1"}})
+	shouldHUP, err := removeFromFile(conf.AddOnHostsFile, "pod1")
+	if err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	if shouldHUP {
+		t.Error("Static entries should not keep the network")
+	}
+	check(staticHostsBegin + "\n192.168.0.1\tgateway\n" + staticHostsEnd + "\n")
+
+	add([]StaticHost{{Name: "gateway", IP: "192.168.0.254"}, {Name: "registry", IP: "192.168.0.3", Aliases: []string{"registry.local"}}})
+	check(staticHostsBegin + "\n192.168.0.254\tgateway\n192.168.0.3\tregistry\tregistry.local\n" + staticHostsEnd + "\n192.168.0.2\tpod1\n")
+
+	if err := conf.replaceStaticHosts([]StaticHost{{Name: "gateway", IP: "invalid"}}); err == nil {
+		t.Error("Invalid static host address should be rejected")
+	}
+	if err := conf.replaceStaticHosts(nil); err != nil {
+		t.Fatalf("Can't replace static hosts: %v", err)
+	}
+	check("192.168.0.2\tpod1\n")
+}
+
+func Test_removeFromFileKeepsComments(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	initialContent := `# static entries of pod1 and pod2
+
+192.168.0.1	pod1
+# pod2 is managed manually
+192.168.0.2	pod2
+`
+	if err := ioutil.WriteFile(testFile, []byte(initialContent), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	if _, err := removeFromFile(testFile, "pod1"); err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	testResult := `# static entries of pod1 and pod2
+
+# pod2 is managed manually
+192.168.0.2	pod2
+`
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("removeFromFile() got = '%v', want '%v'", string(got), testResult)
+	}
+}
+
+func Test_addPodEntryPTRRollback(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		AddOnHostsFile:       path.Join(tmpDir, hostsFileName),
+		LocalServersConfFile: path.Join(tmpDir, localServersConfFileName),
+		Domain:               "foobar.org",
+		PTRRecords:           true,
+	}
+	initialContent := `192.168.0.1	pod1
+`
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte(initialContent), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	// reverse records can't be written to a directory
+	if err := os.Mkdir(conf.LocalServersConfFile, 0700); err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	entry := PodEntry{Name: "pod2", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}}
+	if _, err := conf.addPodEntry(entry); err == nil {
+		t.Fatal("Entry should not be added due to reverse records failure")
+	}
+	got, err := ioutil.ReadFile(conf.AddOnHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != initialContent {
+		t.Errorf("Forward records are not rolled back, got = '%v', want '%v'", string(got), initialContent)
+	}
+	if err := os.Remove(conf.LocalServersConfFile); err != nil {
+		t.Fatalf("Can't remove dir: %v", err)
+	}
+	confChanged, err := conf.addPodEntry(entry)
+	if err != nil {
+		t.Fatalf("Can't add entry: %v", err)
+	}
+	if !confChanged {
+		t.Error("Config should be changed")
+	}
+	data, err := ioutil.ReadFile(conf.LocalServersConfFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != "ptr-record=2.0.168.192.in-addr.arpa,pod2.foobar.org\n" {
+		t.Errorf("Wrong reverse records: %s", string(data))
+	}
+	shouldHUP, confChanged, err := conf.removePodEntry("pod2")
+	if err != nil {
+		t.Fatalf("Can't remove entry: %v", err)
+	}
+	if !shouldHUP || !confChanged {
+		t.Errorf("Wrong remove result, should HUP: %v, config changed: %v", shouldHUP, confChanged)
+	}
+	if data, err = ioutil.ReadFile(conf.LocalServersConfFile); err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if len(data) != 0 {
+		t.Errorf("Reverse records are not removed: %s", string(data))
+	}
+}
+
+func Test_generateDNSMasqConfigLogFile(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+		LogFile:          "/var/log/dnsmasq-cni0.log",
+	}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if !strings.HasSuffix(string(got), "\nlog-facility=/var/log/dnsmasq-cni0.log\n") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want log-facility line", string(got))
+	}
+	testConfig.LogFile = ""
+	if got, err = generateDNSMasqConfig(testConfig); err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if strings.Contains(string(got), "log-facility") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want no log-facility line", string(got))
+	}
+}
+
+func Test_generateDNSMasqConfigLogOptions(t *testing.T) {
+	defaultConfig, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com"})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	tests := []struct {
+		name       string
+		logFile    string
+		logQueries bool
+		want       string
+	}{
+		{"neither", "", false, ""},
+		{"log file", "/var/log/dnsmasq.log", false, "\nlog-facility=/var/log/dnsmasq.log"},
+		{"log queries", "", true, "\nlog-queries"},
+		{"both", "/var/log/dnsmasq.log", true, "\nlog-facility=/var/log/dnsmasq.log\nlog-queries"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", LogFile: tt.logFile, LogQueries: tt.logQueries})
+			if err != nil {
+				t.Fatalf("Can't generate config: %v", err)
+			}
+			// the log lines are appended to the default config only
+			want := strings.TrimSuffix(string(defaultConfig), "\n") + tt.want + "\n"
+			if string(got) != want {
+				t.Errorf("generateDNSMasqConfig() got = '%v', want '%v'", string(got), want)
+			}
+		})
+	}
+	if _, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", LogFile: "dnsmasq.log"}); err == nil {
+		t.Error("Relative log file should be rejected")
+	}
+}
+
+func Test_generateDNSMasqConfigLogQueries(t *testing.T) {
+	for _, networkName := range []string{"net1", "net2"} {
+		conf := DNSNameConf{DomainName: "foobar.org", LogQueries: true}
+		conf.Name = networkName
+		testConfig, err := newDNSMasqFileFromConf(&conf, "cni0")
+		if err != nil {
+			t.Fatalf("Can't create config: %v", err)
+		}
+		got, err := generateDNSMasqConfig(testConfig)
+		if err != nil {
+			t.Fatalf("generateDNSMasqConfig() error = %v", err)
+		}
+		want := fmt.Sprintf("\nlog-facility=%s\n", makePath(networkName, queryLogFileName))
+		if !strings.Contains(string(got), want) || !strings.HasSuffix(string(got), "\nlog-queries\n") {
+			t.Errorf("generateDNSMasqConfig() got = '%v', want per-network query log", string(got))
+		}
+	}
+}
+
+func Test_verifyDNSMasqConfig(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		AddOnHostsFile:   path.Join(tmpDir, hostsFileName),
+		ConfigFile:       path.Join(tmpDir, confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          path.Join(tmpDir, pidFileName),
+	}
+	if err := checkForDNSMasqConfFile(conf); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if err := verifyDNSMasqConfig(conf); err != nil {
+		t.Errorf("Config should match: %v", err)
+	}
+	data, err := ioutil.ReadFile(conf.ConfigFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	// comments are ignored
+	edited := strings.Replace(string(data), "## LIKELY TO AUTOMATICALLY BE REPLACED.\n", "", 1)
+	if err := ioutil.WriteFile(conf.ConfigFile, []byte(edited), 0644); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err := verifyDNSMasqConfig(conf); err != nil {
+		t.Errorf("Config should match: %v", err)
+	}
+	edited = strings.Replace(edited, "domain=foobar.org", "domain=other.org", 1)
+	if err := ioutil.WriteFile(conf.ConfigFile, []byte(edited), 0644); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	err = verifyDNSMasqConfig(conf)
+	if err == nil || !strings.Contains(err.Error(), `"domain=other.org", expected "domain=foobar.org"`) {
+		t.Errorf("Config mismatch should be reported, got: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.ConfigFile, append(data, "cache-size=0\n"...), 0644); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	if err := verifyDNSMasqConfig(conf); err == nil {
+		t.Error("Unexpected line should be reported")
+	}
+}
+
+func Test_rotateBackups(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{AddOnHostsFile: path.Join(tmpDir, "hosts"), HostsFileBackups: 2}
+	initialContent := `192.168.0.1	pod1
+192.168.0.2	pod2
+192.168.0.3	pod3
+192.168.0.4	pod4
+`
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte(initialContent), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	for _, podname := range []string{"pod1", "pod2", "pod3"} {
+		if _, _, err := conf.removePodEntry(podname); err != nil {
+			t.Fatalf("Can't remove entry: %v", err)
+		}
+	}
+	expected := map[string]string{
+		"hosts":   "192.168.0.4\tpod4\n",
+		"hosts.1": "192.168.0.3\tpod3\n192.168.0.4\tpod4\n",
+		"hosts.2": "192.168.0.2\tpod2\n192.168.0.3\tpod3\n192.168.0.4\tpod4\n",
+	}
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Can't read dir: %v", err)
+	}
+	// the lock of the hosts file is kept next to the backups
+	if len(files) != len(expected)+1 {
+		t.Errorf("Wrong number of files: %d", len(files))
+	}
+	for name, content := range expected {
+		got, err := ioutil.ReadFile(path.Join(tmpDir, name))
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if string(got) != content {
+			t.Errorf("Wrong %s content, got = '%v', want '%v'", name, string(got), content)
+		}
+	}
+}
+
+func Test_generateDNSMasqConfigFilters(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+	}
+	tests := []struct {
+		name       string
+		filterAAAA bool
+		filterANY  bool
+		want       []string
+		notWant    []string
+	}{
+		{"none", false, false, nil, []string{"filter-AAAA", "filter-rr=ANY"}},
+		{"AAAA", true, false, []string{"\nfilter-AAAA\n"}, []string{"filter-rr=ANY"}},
+		{"ANY", false, true, []string{"\nfilter-rr=ANY\n"}, []string{"filter-AAAA"}},
+		{"both", true, true, []string{"\nfilter-AAAA\nfilter-rr=ANY\n"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig.FilterAAAA, testConfig.FilterANY = tt.filterAAAA, tt.filterANY
+			got, err := generateDNSMasqConfig(testConfig)
+			if err != nil {
+				t.Fatalf("generateDNSMasqConfig() error = %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("generateDNSMasqConfig() got = '%v', want '%v'", string(got), want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(string(got), notWant) {
+					t.Errorf("generateDNSMasqConfig() got = '%v', should not contain '%v'", string(got), notWant)
+				}
+			}
+		})
+	}
+}
+
+func Test_importHostsFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	sourceFile := path.Join(tmpDir, "source")
+	initialContent := `192.168.0.1	pod1	aliasPod1
+`
+	if err := ioutil.WriteFile(testFile, []byte(initialContent), 0644); err != nil {
+		t.Fatalf("Can't write initial file: %v", err)
+	}
+	sourceContent := `# imported hosts
+10.0.0.1	registry registry.local # local registry
+10.0.0.2	aliasPod1
+fd00::1	registry
+
+not-an-ip	bad
+10.0.0.3	gateway
+`
+	if err := ioutil.WriteFile(sourceFile, []byte(sourceContent), 0644); err != nil {
+		t.Fatalf("Can't write source file: %v", err)
+	}
+	imported, err := importHostsFile(testFile, sourceFile, defaultFileMode)
+	if err != nil {
+		t.Fatalf("Can't import hosts file: %v", err)
+	}
+	if imported != 2 {
+		t.Errorf("Wrong number of imported entries: %d", imported)
+	}
+	testResult := `192.168.0.1	pod1	aliasPod1
+10.0.0.1	registry	registry.local
+fd00::1	registry	registry.local
+10.0.0.3	gateway
+`
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != testResult {
+		t.Errorf("importHostsFile(, defaultFileMode) got = '%v', want '%v'", string(got), testResult)
+	}
+}
+
+func Test_validateInterfaceName(t *testing.T) {
+	if err := validateInterfaceName("cni-podman0"); err != nil {
+		t.Errorf("Valid interface name is rejected: %v", err)
+	}
+	if err := validateInterfaceName("cni-podman01234"); err != nil {
+		t.Errorf("Interface name of maximum length is rejected: %v", err)
+	}
+	err := addIPTablesChain("cni-podman012345", defaultDNSPort, true, ipTablesPlacement{})
+	if err == nil || !strings.Contains(err.Error(), "longer than 15 characters") {
+		t.Errorf("Over-length interface name should be rejected, got: %v", err)
+	}
+	if err := deleteIPTablesChain("cni-podman012345", defaultDNSPort, true, ipTablesPlacement{}); err == nil {
+		t.Error("Over-length interface name should be rejected")
+	}
+	for _, name := range []string{"", ".", "..", "cni/0", "../cni0", "cni 0", "cni0\n", "cni:0", "cni\x00"} {
+		if err := validateInterfaceName(name); err == nil {
+			t.Errorf("Invalid interface name %q should be rejected", name)
+		}
+	}
+	netConf := DNSNameConf{DomainName: "foobar.org"}
+	if _, err := newDNSMasqFileFromConf(&netConf, "../cni0"); err == nil {
+		t.Error("Interface name with a slash should be rejected before it is used")
+	}
+}
+
+func Test_generateDNSMasqConfigDomain(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "dns.podman",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+	}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if !strings.Contains(string(got), "\nlocal=/dns.podman/\ndomain=dns.podman\n") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want domain lines", string(got))
+	}
+	for _, invalid := range []string{"", "foobar.org\nserver=1.1.1.1", "foo bar.org", "foo..org", "-foo.org"} {
+		testConfig.Domain = invalid
+		if _, err := generateDNSMasqConfig(testConfig); err == nil {
+			t.Errorf("Invalid domain %q is accepted", invalid)
+		}
+	}
+}
+
+func Test_generateDNSMasqConfigExtraOptions(t *testing.T) {
+	got, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", LogQueries: true, ExtraOptions: []string{"dns-forward-max=300", "stop-dns-rebind"}})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if !strings.HasSuffix(string(got), "\nlog-queries\ndns-forward-max=300\nstop-dns-rebind\n") {
+		t.Errorf("Extra options should be appended at the end: %s", got)
+	}
+	for _, option := range []string{"", "stop-dns-rebind\nno-resolv", "stop-dns-rebind\r"} {
+		if _, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", ExtraOptions: []string{option}}); err == nil {
+			t.Errorf("Option %q should be rejected", option)
+		}
+	}
+}
+
+func Test_generateDNSMasqConfigCacheSize(t *testing.T) {
+	got, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", CacheSize: 1000})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if !stringInSlice("cache-size=1000", configLines(got)) {
+		t.Errorf("Config should set the cache size: %s", got)
+	}
+	got, err = generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com"})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if strings.Contains(string(got), "cache-size") {
+		t.Errorf("Config should not set the cache size by default: %s", got)
+	}
+	if _, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", CacheSize: -1}); err == nil {
+		t.Error("Negative cache size should be rejected")
+	}
+}
+
+func Test_generateDNSMasqConfigNegativeCache(t *testing.T) {
+	got, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com"})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if strings.Contains(string(got), "neg-ttl") || strings.Contains(string(got), "no-negcache") {
+		t.Errorf("Config should keep the negative caching by default: %s", got)
+	}
+	got, err = generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", NegTTL: 5})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if !stringInSlice("neg-ttl=5", configLines(got)) {
+		t.Errorf("Config should set the negative TTL: %s", got)
+	}
+	got, err = generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", NoNegcache: true})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if lines := configLines(got); !stringInSlice("no-negcache", lines) || strings.Contains(string(got), "neg-ttl") {
+		t.Errorf("Config should disable the negative caching: %s", got)
+	}
+	if _, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", NegTTL: -1}); err == nil {
+		t.Error("Negative TTL below zero should be rejected")
+	}
+	if _, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", NegTTL: 5, NoNegcache: true}); err == nil {
+		t.Error("Negative TTL with negative caching disabled should be rejected")
+	}
+}
+
+func Test_generateDNSMasqConfigBindMode(t *testing.T) {
+	for mode, directive := range map[string]string{"": "bind-dynamic", bindModeDynamic: "bind-dynamic", bindModeInterfaces: "bind-interfaces"} {
+		got, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", BindMode: mode})
+		if err != nil {
+			t.Fatalf("Can't generate config of bind mode %q: %v", mode, err)
+		}
+		lines := configLines(got)
+		if !stringInSlice(directive, lines) {
+			t.Errorf("Bind mode %q should render %s", mode, directive)
+		}
+		other := "bind-interfaces"
+		if directive == other {
+			other = "bind-dynamic"
+		}
+		if stringInSlice(other, lines) {
+			t.Errorf("Bind mode %q should not render %s", mode, other)
+		}
+	}
+	if _, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", BindMode: "static"}); err == nil {
+		t.Error("Invalid bind mode should be rejected")
+	}
+}
+
+func Test_generateResolvConf(t *testing.T) {
+	got, err := generateResolvConf(net.ParseIP("10.88.0.1"), []string{"foobar.com", "foobar.internal"}, defaultResolvConfNdots)
+	if err != nil {
+		t.Fatalf("Can't generate resolv.conf: %v", err)
+	}
+	testResult := "nameserver 10.88.0.1\nsearch foobar.com foobar.internal\noptions ndots:1\n"
+	if string(got) != testResult {
+		t.Errorf("generateResolvConf() got = '%v', want '%v'", string(got), testResult)
+	}
+	got, err = generateResolvConf(net.ParseIP("10.88.0.1"), nil, 5)
+	if err != nil {
+		t.Fatalf("Can't generate resolv.conf: %v", err)
+	}
+	if testResult = "nameserver 10.88.0.1\noptions ndots:5\n"; string(got) != testResult {
+		t.Errorf("generateResolvConf() got = '%v', want '%v'", string(got), testResult)
+	}
+	if _, err := generateResolvConf(nil, nil, defaultResolvConfNdots); err == nil {
+		t.Error("Missing nameserver should be rejected")
+	}
+	if _, err := generateResolvConf(net.ParseIP("10.88.0.1"), []string{"foo bar"}, defaultResolvConfNdots); err == nil {
+		t.Error("Invalid search domain should be rejected")
+	}
+	for _, ndots := range []int{-1, 16} {
+		netConf := DNSNameConf{DomainName: "foobar.org", Ndots: ndots}
+		if _, err := newDNSMasqFileFromConf(&netConf, "cni0"); err == nil {
+			t.Errorf("Invalid ndots %d should not be accepted", ndots)
+		}
+	}
+}
+
+func Test_generateDNSMasqConfigExpandHosts(t *testing.T) {
+	for _, disableExpandHosts := range []bool{false, true} {
+		got, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.org", DisableExpandHosts: disableExpandHosts})
+		if err != nil {
+			t.Fatalf("Can't generate config: %v", err)
+		}
+		lines := configLines(got)
+		if stringInSlice("expand-hosts", lines) == disableExpandHosts {
+			t.Errorf("Config with disableExpandHosts %v has wrong expand-hosts directive: %s", disableExpandHosts, got)
+		}
+		if !stringInSlice("domain=foobar.org", lines) {
+			t.Errorf("Config with disableExpandHosts %v should keep the domain: %s", disableExpandHosts, got)
+		}
+	}
+}
+
+func Test_generateDNSMasqConfigReverse(t *testing.T) {
+	tests := []struct {
+		subnet string
+		zones  []string
+	}{
+		{"10.88.0.0/16", []string{"88.10.in-addr.arpa"}},
+		{"10.88.2.0/23", []string{"2.88.10.in-addr.arpa", "3.88.10.in-addr.arpa"}},
+		{"fd00::/64", []string{"0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa"}},
+	}
+	for _, tt := range tests {
+		got, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", Subnet: tt.subnet, Reverse: true})
+		if err != nil {
+			t.Fatalf("Can't generate config: %v", err)
+		}
+		lines := configLines(got)
+		for _, zone := range tt.zones {
+			if !stringInSlice("local=/"+zone+"/", lines) {
+				t.Errorf("Config of %s should contain reverse zone %s: %s", tt.subnet, zone, got)
+			}
+		}
+		// without the reverse option the subnet doesn't change the config
+		got, err = generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", Subnet: tt.subnet})
+		if err != nil {
+			t.Fatalf("Can't generate config: %v", err)
+		}
+		if strings.Contains(string(got), ".arpa") {
+			t.Errorf("Config should not contain reverse zones: %s", got)
+		}
+	}
+	if _, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.com", Reverse: true}); err == nil {
+		t.Error("Reverse zones without subnet should be rejected")
+	}
+}
+
+func Test_generateDNSMasqConfigWildcards(t *testing.T) {
+	conf := dnsNameFile{Domain: "foobar.org", Domains: []string{"other.org"}}
+	plain, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if strings.Contains(string(plain), "address=") {
+		t.Errorf("Config without wildcards should not contain address lines: %s", plain)
+	}
+	conf.Wildcards = []WildcardAddress{{Domain: "svc.foobar.org", IP: "10.0.0.5"}}
+	got, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	lines := configLines(got)
+	if !stringInSlice("address=/svc.foobar.org/10.0.0.5", lines) {
+		t.Errorf("Config should contain the wildcard address: %s", got)
+	}
+	// the rest of the config is intact
+	var rest []string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "address=") {
+			rest = append(rest, line)
+		}
+	}
+	if !reflect.DeepEqual(rest, configLines(plain)) {
+		t.Errorf("Wildcards should not change the rest of the config: %s", got)
+	}
+	for _, wildcard := range []WildcardAddress{
+		{Domain: "svc.foobar.org", IP: "10.0.0"},
+		{Domain: "svc.example.org", IP: "10.0.0.5"},
+		{Domain: "foobar.org", IP: "10.0.0.5"},
+		{Domain: "s/vc.foobar.org", IP: "10.0.0.5"},
+	} {
+		conf.Wildcards = []WildcardAddress{wildcard}
+		if _, err := generateDNSMasqConfig(conf); err == nil {
+			t.Errorf("Wildcard %v should be rejected", wildcard)
+		}
+	}
+	conf.Wildcards = []WildcardAddress{{Domain: "svc.Other.org", IP: "fd00::5"}}
+	if _, err := generateDNSMasqConfig(conf); err != nil {
+		t.Errorf("Wildcard of the additional domain should be accepted: %v", err)
+	}
+}
+
+func Test_generateDNSMasqConfigUseHostsFile(t *testing.T) {
+	for _, useHostsFile := range []bool{false, true} {
+		got, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.org", AddOnHostsFile: "/tmp/addnhosts", UseHostsFile: useHostsFile})
+		if err != nil {
+			t.Fatalf("Can't generate config: %v", err)
+		}
+		lines := configLines(got)
+		if stringInSlice("no-hosts", lines) == useHostsFile {
+			t.Errorf("Config with useHostsFile %v has wrong no-hosts directive: %s", useHostsFile, got)
+		}
+		if !stringInSlice("addn-hosts=/tmp/addnhosts", lines) {
+			t.Errorf("Config with useHostsFile %v should keep the addn-hosts file: %s", useHostsFile, got)
+		}
+	}
+}
+
+func Test_generateDNSMasqConfigExceptInterfaces(t *testing.T) {
+	conf := dnsNameFile{Domain: "foobar.org", NetworkInterface: "cni0"}
+	plain, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	conf.ExceptInterfaces = []string{"lo"}
+	got, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if !bytes.Equal(got, plain) || !stringInSlice("except-interface=lo", configLines(got)) {
+		t.Errorf("Default except interfaces should not change the config: %s", got)
+	}
+	conf.ExceptInterfaces = []string{"lo", "eth0"}
+	got, err = generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if !strings.Contains(string(got), "except-interface=lo\nexcept-interface=eth0\n") {
+		t.Errorf("Config should exclude both interfaces: %s", got)
+	}
+	for _, iface := range []string{"", "eth 0", "eth0,eth1", "a-very-long-interface-name"} {
+		conf.ExceptInterfaces = []string{iface}
+		if _, err := generateDNSMasqConfig(conf); err == nil {
+			t.Errorf("Except interface %q should be rejected", iface)
+		}
+	}
+}
+
+func Test_configWasModified(t *testing.T) {
+	tmpDir := t.TempDir()
+	conf := dnsNameFile{
+		Domain:         "foobar.org",
+		ConfigFile:     path.Join(tmpDir, confFileName),
+		PidFile:        path.Join(tmpDir, pidFileName),
+		ConfigChecksum: true,
+	}
+	config, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if !strings.HasPrefix(string(config), configHeaderPrefix+" ") || !strings.Contains(strings.SplitN(string(config), "\n", 2)[0], "sha256:") {
+		t.Errorf("Config should start with the checksum header: %s", config)
+	}
+	// the header doesn't change the directives
+	conf.ConfigChecksum = false
+	plain, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if _, body := splitConfigHeader(config); !bytes.Equal(body, plain) {
+		t.Errorf("Config body should match the config without the header: %s", config)
+	}
+	conf.ConfigChecksum = true
+	if err := ioutil.WriteFile(conf.ConfigFile, config, 0644); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if modified, err := configWasModified(conf.ConfigFile); err != nil || modified {
+		t.Errorf("Untouched config should not be modified: %v", err)
+	}
+	if err := verifyDNSMasqConfig(conf); err != nil {
+		t.Errorf("Untouched config should be verified: %v", err)
+	}
+	// the regenerated config with the same body is not rewritten
+	oldTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(conf.ConfigFile, oldTime, oldTime); err != nil {
+		t.Fatalf("Can't change file time: %v", err)
+	}
+	if err := regenerateConfig(conf); err != nil {
+		t.Fatalf("Can't regenerate config: %v", err)
+	}
+	if info, err := os.Stat(conf.ConfigFile); err != nil || !info.ModTime().Equal(oldTime) {
+		t.Errorf("Matching config should not be rewritten: %v", err)
+	}
+
+	// the hand-edited config, even if only a comment is changed
+	if err := ioutil.WriteFile(conf.ConfigFile, append(config, "# tuned by hand\n"...), 0644); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if modified, err := configWasModified(conf.ConfigFile); err != nil || !modified {
+		t.Errorf("Edited config should be modified: %v", err)
+	}
+	if err := verifyDNSMasqConfig(conf); err == nil || !strings.Contains(err.Error(), "modified outside") {
+		t.Errorf("Edited config should be reported, got: %v", err)
+	}
+
+	// the config without the header can't be checked
+	if err := ioutil.WriteFile(conf.ConfigFile, append(plain, "cache-size=0\n"...), 0644); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if modified, err := configWasModified(conf.ConfigFile); err != nil || modified {
+		t.Errorf("Config without header should not be reported as modified: %v", err)
+	}
+}
+
+func Test_generateDNSMasqConfigResolvFile(t *testing.T) {
+	got, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.org"})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if strings.Contains(string(got), "resolv-file=") {
+		t.Errorf("Config without resolvFile should keep the default resolv file: %s", got)
+	}
+	got, err = generateDNSMasqConfig(dnsNameFile{Domain: "foobar.org", ResolvFile: "/etc/dnsname/upstream.conf"})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if !stringInSlice("resolv-file=/etc/dnsname/upstream.conf", configLines(got)) {
+		t.Errorf("Config should have the resolv file: %s", got)
+	}
+	if _, err := generateDNSMasqConfig(dnsNameFile{Domain: "foobar.org", ResolvFile: "upstream.conf"}); err == nil {
+		t.Error("Relative resolv file should be rejected")
+	}
+}
+
+func Test_generateDNSMasqConfigIDN(t *testing.T) {
+	got, err := generateDNSMasqConfig(dnsNameFile{Domain: "müller.example", Domains: []string{"bücher.example"}})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	lines := configLines(got)
+	for _, line := range []string{"local=/xn--mller-kva.example/", "local=/xn--bcher-kva.example/", "domain=xn--mller-kva.example"} {
+		if !stringInSlice(line, lines) {
+			t.Errorf("Config should contain %q: %s", line, got)
+		}
+	}
+	got, err = generateDNSMasqConfig(dnsNameFile{Domain: "FooBar.example"})
+	if err != nil {
+		t.Fatalf("Can't generate config: %v", err)
+	}
+	if lines := configLines(got); !stringInSlice("domain=FooBar.example", lines) || !stringInSlice("local=/FooBar.example/", lines) {
+		t.Errorf("ASCII domain should not be changed: %s", got)
+	}
+	if _, err := generateDNSMasqConfig(dnsNameFile{Domain: "mü ller.example"}); err == nil {
+		t.Error("Invalid internationalized domain should be rejected")
+	}
+}
+
+func Test_generateDNSMasqConfigDomains(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domains:          []string{"foobar.org", "example.org"},
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+	}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if !strings.Contains(string(got), "\nlocal=/foobar.org/\nlocal=/example.org/\ndomain=foobar.org\n") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want local lines of both domains", string(got))
+	}
+	testConfig.Domains = nil
+	if _, err := generateDNSMasqConfig(testConfig); err == nil {
+		t.Error("Config without domains should be rejected")
+	}
+	testConfig.Domains = []string{"foobar.org", "example.org\nserver=1.1.1.1"}
+	if _, err := generateDNSMasqConfig(testConfig); err == nil {
+		t.Error("Invalid additional domain should be rejected")
+	}
+}
+
+func Test_generateDNSMasqConfigNameservers(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+	}
+	expected, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	testConfig.Nameservers = []string{"1.1.1.1", "2001:db8::1#5353"}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if string(got) != strings.Replace(string(expected), "\nconf-file=\n", "\nconf-file=\nserver=1.1.1.1\nserver=2001:db8::1#5353\n", 1) {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want server lines", string(got))
+	}
+	for _, invalid := range []string{"", "dns.google", "1.1.1.1#", "1.1.1.1#65536", "1.1.1.1\nlocal=/a/"} {
+		if err := validateNameservers([]string{invalid}); err == nil {
+			t.Errorf("Invalid nameserver %q is accepted", invalid)
+		}
+	}
+}
+
+func Test_generateDNSMasqConfigAddSubnet(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+		AddSubnet:        "24,56",
+	}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if !strings.HasSuffix(string(got), "\nadd-subnet=24,56\n") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want add-subnet line", string(got))
+	}
+	for _, valid := range []string{"32", "10.0.0.0/24", ",64", "24,2001:db8::/56"} {
+		if err := validateAddSubnet(valid); err != nil {
+			t.Errorf("Valid add-subnet %q is rejected: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"33", "fd00::/24", "24,129", "10.0.0.0/24,fd00::/56,1", "24\nserver=1.1.1.1"} {
+		if err := validateAddSubnet(invalid); err == nil {
+			t.Errorf("Invalid add-subnet %q is accepted", invalid)
+		}
+	}
+}
+
+func Test_generateDNSMasqConfigDNSLoopDetect(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+	}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if strings.Contains(string(got), "dns-loop-detect") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', loop detection should be off by default", string(got))
+	}
+	testConfig.DNSLoopDetect = true
+	if got, err = generateDNSMasqConfig(testConfig); err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if !strings.HasSuffix(string(got), "\ndns-loop-detect\n") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want dns-loop-detect line", string(got))
+	}
+}
+
+func Test_generateDNSMasqConfigDNSPort(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+		DNSPort:          5353,
+	}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if !strings.Contains(string(got), "\npid-file="+testConfig.PidFile+"\nport=5353\n") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want port line", string(got))
+	}
+	for _, args := range ruleArgs(testConfig.NetworkInterface, testConfig.port()) {
+		if !strings.Contains(strings.Join(args, " "), "--dport 5353 ") {
+			t.Errorf("Wrong rule args: %v", args)
+		}
+	}
+	if servers := testConfig.serverAddresses([]string{"10.88.0.1"}); !reflect.DeepEqual(servers, []string{"10.88.0.1#5353"}) {
+		t.Errorf("Wrong server addresses: %v", servers)
+	}
+	testConfig.DNSPort = 0
+	if testConfig.port() != defaultDNSPort {
+		t.Errorf("Wrong default port: %d", testConfig.port())
+	}
+}
+
+func Test_generateDNSMasqConfigLocalService(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+	}
+	got, err := generateDNSMasqConfig(testConfig)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if strings.Contains(string(got), "local-service") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', local-service should be off by default", string(got))
+	}
+	testConfig.LocalService = true
+	if got, err = generateDNSMasqConfig(testConfig); err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if !strings.HasSuffix(string(got), "\nlocal-service\n") {
+		t.Errorf("generateDNSMasqConfig() got = '%v', want local-service line", string(got))
+	}
+}
+
+func Test_generateDNSMasqConfigForwarding(t *testing.T) {
+	testConfig := dnsNameFile{
+		AddOnHostsFile:   makePath("cni0", hostsFileName),
+		ConfigFile:       makePath("cni0", confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("cni0", pidFileName),
+	}
+	tests := []struct {
+		forwarding string
+		want       string
+	}{
+		{"", "all-servers\nstrict-order\nlocal="},
+		{forwardingAllServers, "REPLACED.\nall-servers\nlocal="},
+		{forwardingStrictOrder, "REPLACED.\nstrict-order\nlocal="},
+		{forwardingDefault, "REPLACED.\nlocal="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.forwarding, func(t *testing.T) {
+			testConfig.Forwarding = tt.forwarding
+			got, err := generateDNSMasqConfig(testConfig)
+			if err != nil {
+				t.Fatalf("generateDNSMasqConfig() error = %v", err)
+			}
+			if !strings.Contains(string(got), tt.want) {
+				t.Errorf("generateDNSMasqConfig() got = '%v', want '%v'", string(got), tt.want)
+			}
+		})
+	}
+	conf := DNSNameConf{DomainName: "foobar.org", Forwarding: "fastest"}
+	if _, err := newDNSMasqFileFromConf(&conf, "cni0"); err == nil {
+		t.Error("Invalid forwarding strategy should not be accepted")
+	}
+}
+
+func Test_hostRecordEntryFormat(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		AddOnHostsFile:       path.Join(tmpDir, hostsFileName),
+		LocalServersConfFile: path.Join(tmpDir, localServersConfFileName),
+		EntryFormat:          entryFormatHostRecord,
+	}
+	entries := []PodEntry{
+		{Name: "pod1", Aliases: []string{"aliasPod1"}, IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}, {IP: net.ParseIP("fd00::1")}}},
+		{Name: "pod2", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}, TTL: 60},
+	}
+	for _, entry := range entries {
+		confChanged, err := conf.addPodEntry(entry)
+		if err != nil {
+			t.Fatalf("Can't add entry: %v", err)
+		}
+		if !confChanged {
+			t.Error("Config should be changed")
+		}
+	}
+	if _, err := conf.addPodEntry(PodEntry{Name: "pod3", Aliases: []string{"aliasPod1"},
+		IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 3}}}}); err == nil {
+		t.Error("Entry should not be added due to unique alias violation")
+	}
+	if _, err := os.Stat(conf.AddOnHostsFile); !os.IsNotExist(err) {
+		t.Error("Hosts file should not be created")
+	}
+	expected := `host-record=pod1,aliasPod1,192.168.0.1
+host-record=pod1,aliasPod1,fd00::1
+host-record=pod2,192.168.0.2,60
+`
+	data, err := ioutil.ReadFile(conf.LocalServersConfFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != expected {
+		t.Fatalf("Expected: %s got: %s", expected, string(data))
+	}
+	shouldHUP, confChanged, err := conf.removePodEntry("pod1")
+	if err != nil {
+		t.Fatalf("Can't remove entry: %v", err)
+	}
+	if !shouldHUP || !confChanged {
+		t.Errorf("Wrong remove result, should HUP: %v, config changed: %v", shouldHUP, confChanged)
+	}
+	if shouldHUP, _, err = conf.removePodEntry("pod2"); err != nil {
+		t.Fatalf("Can't remove entry: %v", err)
+	}
+	if shouldHUP {
+		t.Error("No entries should be left")
+	}
+	if data, err = ioutil.ReadFile(conf.LocalServersConfFile); err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if len(data) != 0 {
+		t.Errorf("Host records are not removed: %s", string(data))
+	}
+}
+
+func Test_perEntryDomains(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	for i, domain := range []string{"tenantA.example", "tenantB.example."} {
+		_, _, podname, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "dnsname"}`),
+			"K8S_POD_NAME=pod;DNS_DOMAIN="+domain)
+		if err != nil {
+			t.Fatalf("Can't parse config: %v", err)
+		}
+		if err := appendToFile(testFile, podname, []string{qualifyName("web", strings.TrimSuffix(domain, "."))},
+			[]*net.IPNet{{IP: net.IP{192, 168, 0, byte(i + 1)}}}, defaultFileMode); err != nil {
+			t.Fatalf("Can't append to file: %v", err)
+		}
+	}
+	if _, _, _, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "dnsname"}`),
+		"K8S_POD_NAME=pod;DNS_DOMAIN=tenant_A"); err == nil {
+		t.Error("Invalid domain should not be accepted")
+	}
+	shouldHUP, err := removeFromFile(testFile, "pod.tenantA.example")
+	if err != nil {
+		t.Fatalf("Can't remove from file: %v", err)
+	}
+	if !shouldHUP {
+		t.Error("Should HUP")
+	}
+	expected := "192.168.0.2\tpod.tenantB.example\tweb.tenantB.example\n"
+	data, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != expected {
+		t.Errorf("Expected: %s got: %s", expected, string(data))
+	}
+}
+
+func Test_reserveInFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, "hosts")
+	if err := appendToFile(testFile, "pod1", nil, []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	if err := reserveInFile(testFile, "pod1", nil, defaultFileMode); err == nil {
+		t.Error("Existing host should not be reserved")
+	}
+	if err := reserveInFile(testFile, "pod2", []string{"aliasPod2"}, defaultFileMode); err != nil {
+		t.Fatalf("Can't reserve: %v", err)
+	}
+	if err := reserveInFile(testFile, "pod2", nil, defaultFileMode); err == nil {
+		t.Error("Host should not be reserved twice")
+	}
+	if err := appendToFile(testFile, "pod3", []string{"aliasPod2"}, []*net.IPNet{{IP: net.IP{192, 168, 0, 3}}}, defaultFileMode); err == nil {
+		t.Error("Reserved alias should not be appended")
+	}
+	if err := reserveInFile(testFile, "pod4", nil, defaultFileMode); err != nil {
+		t.Fatalf("Can't reserve: %v", err)
+	}
+
+	// reserve then fill
+	if err := appendToFile(testFile, "pod2", []string{"aliasPod2"}, []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't fill reservation: %v", err)
+	}
+	// reserve then release
+	shouldHUP, err := removeFromFile(testFile, "pod4")
+	if err != nil {
+		t.Fatalf("Can't release: %v", err)
+	}
+	if !shouldHUP {
+		t.Error("Should HUP")
+	}
+	expected := "192.168.0.1\tpod1\n192.168.0.2\tpod2\taliasPod2\n"
+	data, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != expected {
+		t.Errorf("Expected: %s got: %s", expected, string(data))
+	}
+
+	// reservations keep the network
+	if err := reserveInFile(testFile, "pod5", nil, defaultFileMode); err != nil {
+		t.Fatalf("Can't reserve: %v", err)
+	}
+	for _, podname := range []string{"pod1", "pod2"} {
+		if shouldHUP, err = removeFromFile(testFile, podname); err != nil {
+			t.Fatalf("Can't remove from file: %v", err)
+		}
+	}
+	if !shouldHUP {
+		t.Error("Reservation should be counted as entry")
+	}
+}
+
+func Test_reserveInFileLocked(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	testFile := path.Join(tmpDir, hostsFileName)
+	lock, err := lockHostsFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't lock hosts file: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- reserveInFile(testFile, "pod1", nil, 0600)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Reservation should wait for the hosts file lock, got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := lock.release(); err != nil {
+		t.Fatalf("Can't release lock: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Can't reserve: %v", err)
+	}
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if expected := reservationMarker + "\tpod1\n"; string(got) != expected {
+		t.Errorf("Expected: %q got: %q", expected, string(got))
+	}
+	if info, err := os.Stat(testFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Hosts file should be created with the given mode: %v", err)
+	}
+	if err := releaseInFile(testFile, "pod1"); err != nil {
+		t.Fatalf("Can't release: %v", err)
+	}
+	if got, err = ioutil.ReadFile(testFile); err != nil || len(got) != 0 {
+		t.Errorf("Reservation should be released, got %q: %v", string(got), err)
+	}
+}
+
+func Test_addPodEntryValidateHostsFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		AddOnHostsFile:    path.Join(tmpDir, hostsFileName),
+		ValidateHostsFile: true,
+	}
+	// rollback of the new file
+	if _, err := conf.addPodEntry(PodEntry{Name: "pod_1", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}}}); err == nil {
+		t.Error("Invalid entry should not be added")
+	}
+	if _, err := os.Stat(conf.AddOnHostsFile); !os.IsNotExist(err) {
+		t.Error("Hosts file should be removed on rollback")
+	}
+	if _, err := conf.addPodEntry(PodEntry{Name: "pod1", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}}}); err != nil {
+		t.Fatalf("Can't add entry: %v", err)
+	}
+	// rollback of the existing file
+	if _, err := conf.addPodEntry(PodEntry{Name: "pod2", Aliases: []string{"-alias"},
+		IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}}); err == nil {
+		t.Error("Invalid entry should not be added")
+	}
+	expected := "192.168.0.1\tpod1\n"
+	data, err := ioutil.ReadFile(conf.AddOnHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != expected {
+		t.Errorf("Expected: %s got: %s", expected, string(data))
+	}
+}
+
+func Test_addPodEntryPrimaryIPOnly(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		AddOnHostsFile: path.Join(tmpDir, hostsFileName),
+		PrimaryIPOnly:  true,
+	}
+	entry := PodEntry{Name: "pod1", IPs: []*net.IPNet{
+		{IP: net.ParseIP("fd00::1")}, {IP: net.IP{192, 168, 0, 1}}, {IP: net.IP{10, 0, 0, 1}}, {IP: net.ParseIP("fd00::2")},
+	}}
+	expected := "192.168.0.1\tpod1\nfd00::1\tpod1\n"
+	// the entry is the same after the pod is re-added
+	for i := 0; i < 2; i++ {
+		if _, err := conf.addPodEntry(entry); err != nil {
+			t.Fatalf("Can't add entry: %v", err)
+		}
+		data, err := ioutil.ReadFile(conf.AddOnHostsFile)
+		if err != nil {
+			t.Fatalf("Can't read file: %v", err)
+		}
+		if string(data) != expected {
+			t.Errorf("Expected: %s got: %s", expected, string(data))
+		}
+		if _, _, err := conf.removePodEntry(entry.Name); err != nil {
+			t.Fatalf("Can't remove entry: %v", err)
+		}
+	}
+}
+
+func Test_addPodEntrySubnet(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		AddOnHostsFile: path.Join(tmpDir, hostsFileName),
+		Subnet:         "192.168.0.0/24",
+	}
+	if _, err := conf.addPodEntry(PodEntry{Name: "pod1", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}}}); err != nil {
+		t.Fatalf("Can't add entry: %v", err)
+	}
+	outOfSubnet := PodEntry{Name: "pod2", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}, {IP: net.IP{10, 0, 0, 2}}}}
+	if _, err := conf.addPodEntry(outOfSubnet); err == nil {
+		t.Error("Entry out of subnet should be rejected")
+	}
+	conf.OutOfSubnet = outOfSubnetSkip
+	if _, err := conf.addPodEntry(outOfSubnet); err != nil {
+		t.Fatalf("Can't add entry: %v", err)
+	}
+	if _, err := conf.addPodEntry(PodEntry{Name: "pod3", IPs: []*net.IPNet{{IP: net.IP{10, 0, 0, 3}}}}); err == nil {
+		t.Error("Entry without addresses in subnet should be rejected")
+	}
+	expected := "192.168.0.1\tpod1\n192.168.0.2\tpod2\n"
+	data, err := ioutil.ReadFile(conf.AddOnHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != expected {
+		t.Errorf("Expected: %s got: %s", expected, string(data))
+	}
+	for _, subnet := range []string{"192.168.0.0", "192.168.0.0/33"} {
+		conf := DNSNameConf{DomainName: "foobar.org", Subnet: subnet}
+		if _, err := newDNSMasqFileFromConf(&conf, "cni0"); err == nil {
+			t.Errorf("Invalid subnet %q should not be accepted", subnet)
+		}
+	}
+}
+
+func Test_replaceEntries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	desired := []PodEntry{
+		{Name: "pod1", Aliases: []string{"aliasPod1"}, IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}, {IP: net.ParseIP("fd00::1")}}},
+		{Name: "pod2", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}},
+	}
+	incremental := path.Join(tmpDir, "incremental")
+	for _, entry := range desired {
+		if err := appendToFile(incremental, entry.Name, entry.Aliases, entry.IPs, defaultFileMode); err != nil {
+			t.Fatalf("Can't append to file: %v", err)
+		}
+	}
+	conf := dnsNameFile{AddOnHostsFile: path.Join(tmpDir, hostsFileName)}
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte("192.168.0.3\tpod3\n192.168.0.4\tpod2\n"), 0644); err != nil {
+		t.Fatalf("Can't write file: %v", err)
+	}
+	changed, err := replaceEntries(conf, desired)
+	if err != nil {
+		t.Fatalf("Can't replace entries: %v", err)
+	}
+	if !changed {
+		t.Error("Entries should be changed")
+	}
+	expected, err := ioutil.ReadFile(incremental)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	data, err := ioutil.ReadFile(conf.AddOnHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != string(expected) {
+		t.Errorf("Expected: %s got: %s", string(expected), string(data))
+	}
+	if changed, err = replaceEntries(conf, desired); err != nil {
+		t.Fatalf("Can't replace entries: %v", err)
+	}
+	if changed {
+		t.Error("Applying the same entries should not change the file")
+	}
+	duplicated := append(desired, PodEntry{Name: "pod3", Aliases: []string{"aliasPod1"}, IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 3}}}})
+	if _, err := replaceEntries(conf, duplicated); err == nil {
+		t.Error("Duplicated names should not be accepted")
+	}
+	for _, invalid := range [][]PodEntry{
+		{{Name: "a\n1.2.3.4\tevil", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 5}}}}},
+		{{Name: "pod5", Aliases: []string{"alias pod5"}, IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 5}}}}},
+		{{Name: "pod5", IPs: []*net.IPNet{{}}}},
+		{{Name: "pod5", IPs: []*net.IPNet{nil}}},
+	} {
+		if _, err := replaceEntries(conf, invalid); err == nil {
+			t.Errorf("Invalid entry %+v should not be accepted", invalid[0])
+		}
+	}
+	data, err = ioutil.ReadFile(conf.AddOnHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != string(expected) {
+		t.Errorf("Rejected entries should not change the file, got: %s", string(data))
+	}
+}
+
+func Test_replaceEntriesKeepsStaticHosts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{AddOnHostsFile: path.Join(tmpDir, hostsFileName)}
+	if err := appendToFile(conf.AddOnHostsFile, "pod1", nil, []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	if err := reserveInFile(conf.AddOnHostsFile, "pod2", nil, defaultFileMode); err != nil {
+		t.Fatalf("Can't reserve name: %v", err)
+	}
+	if err := reserveInFile(conf.AddOnHostsFile, "pod3", []string{"aliasPod3"}, defaultFileMode); err != nil {
+		t.Fatalf("Can't reserve name: %v", err)
+	}
+	if err := conf.replaceStaticHosts([]StaticHost{{Name: "gateway", IP: "192.168.0.254"}}); err != nil {
+		t.Fatalf("Can't replace static hosts: %v", err)
+	}
+	desired := []PodEntry{
+		{Name: "pod2", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}},
+		{Name: "pod4", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 4}}}},
+	}
+	if _, err := replaceEntries(conf, desired); err != nil {
+		t.Fatalf("Can't replace entries: %v", err)
+	}
+	data, err := ioutil.ReadFile(conf.AddOnHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	expected := reservationMarker + "\tpod3\taliasPod3\n" +
+		"192.168.0.2\tpod2\n" +
+		"192.168.0.4\tpod4\n" +
+		staticHostsBegin + "\n192.168.0.254\tgateway\n" + staticHostsEnd + "\n"
+	if string(data) != expected {
+		t.Errorf("Expected: %q got: %q", expected, string(data))
+	}
+}
+
+func Test_checkForDNSMasqConfFileDrift(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		AddOnHostsFile:   path.Join(tmpDir, hostsFileName),
+		ConfigFile:       path.Join(tmpDir, confFileName),
+		Domain:           "old.org",
+		NetworkInterface: "cni0",
+		PidFile:          path.Join(tmpDir, pidFileName),
+	}
+	if err := checkForDNSMasqConfFile(conf); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	conf.Domain = "new.org"
+	// the existing file is kept by default
+	if err := checkForDNSMasqConfFile(conf); err != nil {
+		t.Fatalf("Can't check config: %v", err)
+	}
+	if data, err := ioutil.ReadFile(conf.ConfigFile); err != nil || !strings.Contains(string(data), "domain=old.org\n") {
+		t.Errorf("Existing config should be kept without drift detection: %v", err)
+	}
+	conf.DetectConfigDrift = true
+	if err := checkForDNSMasqConfFile(conf); err != nil {
+		t.Fatalf("Can't check config: %v", err)
+	}
+	expected, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	if data, err := ioutil.ReadFile(conf.ConfigFile); err != nil || string(data) != string(expected) {
+		t.Errorf("Drifted config should be rewritten, got: %s, %v", string(data), err)
+	}
+}
+
+func Test_checkForDNSMasqConfFileAtomic(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		AddOnHostsFile:   path.Join(tmpDir, hostsFileName),
+		ConfigFile:       path.Join(tmpDir, confFileName),
+		Domain:           "foobar.org",
+		NetworkInterface: "cni0",
+		PidFile:          path.Join(tmpDir, pidFileName),
+	}
+	expected, err := generateDNSMasqConfig(conf)
+	if err != nil {
+		t.Fatalf("generateDNSMasqConfig() error = %v", err)
+	}
+	renamed := false
+	renameFileAtomic = func(oldpath, newpath string) error {
+		renamed = true
+		if _, err := os.Stat(conf.ConfigFile); !os.IsNotExist(err) {
+			t.Error("Config should not exist before rename")
+		}
+		if path.Dir(oldpath) != tmpDir {
+			t.Errorf("Temporary file %s is not in the config dir", oldpath)
+		}
+		if data, err := ioutil.ReadFile(oldpath); err != nil || string(data) != string(expected) {
+			t.Errorf("Temporary file is not complete: %v", err)
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	t.Cleanup(func() { renameFileAtomic = os.Rename })
+	if err := checkForDNSMasqConfFile(conf); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if !renamed {
+		t.Error("Config should be renamed into place")
+	}
+	if info, err := os.Stat(conf.ConfigFile); err != nil || info.Mode().Perm() != defaultFileMode {
+		t.Errorf("Wrong config file: %v", err)
+	}
+
+	// failed rename leaves no temporary files
+	os.Remove(conf.ConfigFile)
+	renameFileAtomic = func(oldpath, newpath string) error {
+		return errors.New("rename failed")
+	}
+	if err := checkForDNSMasqConfFile(conf); err == nil {
+		t.Error("Rename error should be returned")
+	}
+	if items, _ := ioutil.ReadDir(tmpDir); len(items) != 0 {
+		t.Errorf("Temporary file is left: %s", items[0].Name())
+	}
+}
+
+func Test_fileMode(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	netConf := DNSNameConf{DomainName: "foobar.org", FileMode: "0600", HostsFileBackups: 2,
+		MultiDomain: true, PTRRecords: true, ValidateHostsFile: true}
+	conf, err := newDNSMasqFileFromConf(&netConf, "cni0")
+	if err != nil {
+		t.Fatalf("Can't create config: %v", err)
+	}
+	conf.AddOnHostsFile = path.Join(tmpDir, hostsFileName)
+	conf.ConfigFile = path.Join(tmpDir, confFileName)
+	conf.LocalServersConfFile = path.Join(tmpDir, localServersConfFileName)
+	if err := checkForDNSMasqConfFile(conf); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	for i, podname := range []string{"pod1", "pod2"} {
+		if _, err := conf.addPodEntry(PodEntry{Name: podname, IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, byte(i + 1)}}}}); err != nil {
+			t.Fatalf("Can't add entry: %v", err)
+		}
+	}
+	// the invalid entry is rolled back by restoring the hosts file
+	if _, err := conf.addPodEntry(PodEntry{Name: "pod_3", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 3}}}}); err == nil {
+		t.Fatal("Invalid entry should not be added")
+	}
+	if _, _, err := conf.removePodEntry("pod1"); err != nil {
+		t.Fatalf("Can't remove entry: %v", err)
+	}
+	for _, file := range []string{conf.ConfigFile, conf.AddOnHostsFile, conf.AddOnHostsFile + ".1", conf.LocalServersConfFile} {
+		if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Wrong mode of %s: %v", file, err)
+		}
+	}
+	for _, mode := range []string{"0", "1777", "rw"} {
+		netConf := DNSNameConf{DomainName: "foobar.org", FileMode: mode}
+		if _, err := newDNSMasqFileFromConf(&netConf, "cni0"); err == nil {
+			t.Errorf("Invalid file mode %q should not be accepted", mode)
+		}
+	}
+}
+
+func Test_reloadDNSMasq(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	pidFile := path.Join(tmpDir, pidFileName)
+
+	if err := reloadDNSMasq(pidFile); !errors.Is(err, ErrDNSMasqNotRunning) {
+		t.Errorf("Expected not running error for missing pid file, got: %v", err)
+	}
+
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Can't start process: %v", err)
+	}
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	if err := ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+	if err := reloadDNSMasq(pidFile); err != nil {
+		t.Fatalf("Can't reload: %v", err)
+	}
+	// sleep doesn't handle sighup, so it is terminated by the signal
+	err = cmd.Wait()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("Process is not terminated by signal: %v", err)
+	}
+	if status := exitErr.Sys().(syscall.WaitStatus); !status.Signaled() || status.Signal() != syscall.SIGHUP {
+		t.Errorf("Wrong process status: %v", status)
+	}
+
+	// the process is gone, the pid file is stale
+	if err := reloadDNSMasq(pidFile); !errors.Is(err, ErrDNSMasqNotRunning) {
+		t.Errorf("Expected not running error for stale pid file, got: %v", err)
 	}
 }
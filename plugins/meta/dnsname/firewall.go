@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"unicode"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// firewall accepts the DNS queries to the dnsmasq instance on the network
+// interface
+type firewall interface {
+	// ensureAllow adds the rules accepting the DNS queries to the port, the
+	// existing rules are kept
+	ensureAllow(iface string, port int) error
+	// removeAllow removes the rules accepting the DNS queries to the port
+	removeAllow(iface string, port int) error
+	// hasAllow checks whether all rules accepting the DNS queries exist
+	hasAllow(iface string, port int) (bool, error)
+	// probe checks that the firewall can be used on the node
+	probe() error
+}
+
+// newFirewall returns the firewall of the backend, with ipv6 the IPv6 queries
+// are accepted too
+func newFirewall(backend string, ipv6 bool) firewall {
+	if backend == firewallNFTables {
+		return nfTablesFirewall{ipv6: ipv6}
+	}
+	return ipTablesFirewall{ipv6: ipv6}
+}
+
+// firewall returns the firewall of the network
+func (d dnsNameFile) firewall() firewall {
+	if d.DisableFirewall {
+		return unmanagedFirewall{}
+	}
+	if d.dryRun != nil {
+		return dryRunFirewall{artifacts: d.dryRun, backend: d.FirewallBackend, ipv6: !d.DisableIPv6Firewall, placement: d.IPTablesPlacement}
+	}
+	var fw firewall = ipTablesFirewall{ipv6: !d.DisableIPv6Firewall, placement: d.IPTablesPlacement}
+	if d.FirewallBackend == firewallNFTables {
+		fw = newFirewall(d.FirewallBackend, !d.DisableIPv6Firewall)
+	}
+	if d.Netns != "" {
+		return netNSFirewall{firewall: fw, conf: d}
+	}
+	return fw
+}
+
+// netNSFirewall applies the rules of the firewall in the network namespace of
+// the dnsmasq instance
+type netNSFirewall struct {
+	firewall
+	conf dnsNameFile
+}
+
+func (f netNSFirewall) ensureAllow(iface string, port int) error {
+	return f.conf.inNetNS(func() error {
+		return f.firewall.ensureAllow(iface, port)
+	})
+}
+
+func (f netNSFirewall) removeAllow(iface string, port int) error {
+	return f.conf.inNetNS(func() error {
+		return f.firewall.removeAllow(iface, port)
+	})
+}
+
+func (f netNSFirewall) hasAllow(iface string, port int) (bool, error) {
+	var exists bool
+	err := f.conf.inNetNS(func() error {
+		var err error
+		exists, err = f.firewall.hasAllow(iface, port)
+		return err
+	})
+	return exists, err
+}
+
+func (f netNSFirewall) probe() error {
+	return f.conf.inNetNS(f.firewall.probe)
+}
+
+// unmanagedFirewall leaves the firewall to be managed externally, the DNS
+// queries are assumed to be accepted
+type unmanagedFirewall struct{}
+
+func (unmanagedFirewall) ensureAllow(iface string, port int) error {
+	return nil
+}
+
+func (unmanagedFirewall) removeAllow(iface string, port int) error {
+	return nil
+}
+
+func (unmanagedFirewall) hasAllow(iface string, port int) (bool, error) {
+	return true, nil
+}
+
+func (unmanagedFirewall) probe() error {
+	return nil
+}
+
+// dryRunFirewall records the commands adding the rules of the backend instead
+// of changing the firewall
+type dryRunFirewall struct {
+	artifacts *dryRunArtifacts
+	backend   string
+	ipv6      bool
+	placement ipTablesPlacement
+}
+
+func (f dryRunFirewall) ensureAllow(iface string, port int) error {
+	if err := validateInterfaceName(iface); err != nil {
+		return err
+	}
+	if f.backend == firewallNFTables {
+		for _, protocol := range ruleProtocols {
+			rule := []string{"nft", "add", "rule", "inet", nftTable.Name, nftChain().Name}
+			if !f.ipv6 {
+				rule = append(rule, "meta", "nfproto", "ipv4")
+			}
+			rule = append(rule, "iifname", iface, "meta", "l4proto", protocol, "th", "dport", strconv.Itoa(port), "accept")
+			f.artifacts.FirewallRules = append(f.artifacts.FirewallRules, rule)
+		}
+		return nil
+	}
+	for _, protocol := range firewallProtocols(f.ipv6) {
+		command := "iptables"
+		if protocol == iptables.ProtocolIPv6 {
+			command = "ip6tables"
+		}
+		for _, args := range ruleArgs(iface, port) {
+			rule := append([]string{command}, f.placement.commandArgs(args)...)
+			f.artifacts.FirewallRules = append(f.artifacts.FirewallRules, rule)
+		}
+	}
+	return nil
+}
+
+func (f dryRunFirewall) removeAllow(iface string, port int) error {
+	return nil
+}
+
+func (f dryRunFirewall) hasAllow(iface string, port int) (bool, error) {
+	return false, nil
+}
+
+func (f dryRunFirewall) probe() error {
+	return nil
+}
+
+// ipTablesFirewall inserts the rules into the chain of iptables, the filter
+// INPUT one by default, and, with ipv6, of ip6tables
+type ipTablesFirewall struct {
+	ipv6      bool
+	placement ipTablesPlacement
+}
+
+func (f ipTablesFirewall) ensureAllow(iface string, port int) error {
+	return addIPTablesChain(iface, port, f.ipv6, f.placement)
+}
+
+func (f ipTablesFirewall) removeAllow(iface string, port int) error {
+	return deleteIPTablesChain(iface, port, f.ipv6, f.placement)
+}
+
+func (f ipTablesFirewall) hasAllow(iface string, port int) (bool, error) {
+	return hasIPTablesChain(iface, port, f.ipv6, f.placement)
+}
+
+func (f ipTablesFirewall) probe() error {
+	return probeIPTables(f.placement)
+}
+
+// ipTablesPlacement is where the iptables rules are added, the zero value is
+// the top of the filter INPUT chain
+type ipTablesPlacement struct {
+	Table    string
+	Chain    string
+	Position int
+	Append   bool
+}
+
+// table returns the table of the rules
+func (p ipTablesPlacement) table() string {
+	if p.Table == "" {
+		return "filter"
+	}
+	return p.Table
+}
+
+// chain returns the chain of the rules
+func (p ipTablesPlacement) chain() string {
+	if p.Chain == "" {
+		return "INPUT"
+	}
+	return p.Chain
+}
+
+// position returns the insert position of the rules
+func (p ipTablesPlacement) position() int {
+	if p.Position == 0 {
+		return 1
+	}
+	return p.Position
+}
+
+// add adds the rule at the configured position or appends it to the chain
+func (p ipTablesPlacement) add(ip ipTables, args []string) error {
+	if p.Append {
+		return ip.Append(p.table(), p.chain(), args...)
+	}
+	return ip.Insert(p.table(), p.chain(), p.position(), args...)
+}
+
+// commandArgs returns the iptables command arguments adding the rule
+func (p ipTablesPlacement) commandArgs(args []string) []string {
+	if p.Append {
+		return append([]string{"-t", p.table(), "-A", p.chain()}, args...)
+	}
+	return append([]string{"-t", p.table(), "-I", p.chain(), strconv.Itoa(p.position())}, args...)
+}
+
+// validate checks the placement options
+func (p ipTablesPlacement) validate() error {
+	if p.Position < 0 {
+		return errors.Errorf("invalid iptables position %d", p.Position)
+	}
+	if p.Append && p.Position != 0 {
+		return errors.Errorf("iptables position can't be set with append")
+	}
+	return nil
+}
+
+// ruleProtocols are the protocols of the DNS port accepted for the network
+// interface, TCP is used by resolvers for large responses
+var ruleProtocols = []string{"udp", "tcp"}
+
+// ruleArgs returns the iptables rules accepting the DNS queries to the port on
+// the network interface, one per protocol
+func ruleArgs(interfaceName string, port int) [][]string {
+	rules := make([][]string, 0, len(ruleProtocols))
+	for _, protocol := range ruleProtocols {
+		rules = append(rules, []string{"-i", interfaceName, "-p", protocol, "-m", protocol,
+			"--dport", strconv.Itoa(port), "-j", "ACCEPT"})
+	}
+	return rules
+}
+
+// ipTables is the subset of the iptables operations used by the plugin
+type ipTables interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+	ChainExists(table, chain string) (bool, error)
+}
+
+// newIPTables creates the iptables handler of the protocol, it is replaced in tests
+var newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+	return iptables.NewWithProtocol(protocol)
+}
+
+// firewallProtocols returns the protocols of the iptables rules, the IPv6 rules
+// are required for the dual-stack networks
+func firewallProtocols(ipv6 bool) []iptables.Protocol {
+	if ipv6 {
+		return []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6}
+	}
+	return []iptables.Protocol{iptables.ProtocolIPv4}
+}
+
+// addIPTablesChain adds dnsmasq iptables chain, with ipv6 also the ip6tables one
+func addIPTablesChain(interfaceName string, port int, ipv6 bool, placement ipTablesPlacement) error {
+	if err := validateInterfaceName(interfaceName); err != nil {
+		return err
+	}
+	for _, protocol := range firewallProtocols(ipv6) {
+		ip, err := newIPTables(protocol)
+		if err != nil {
+			return err
+		}
+		// each rule is checked separately to repair the partially applied rules
+		for _, args := range ruleArgs(interfaceName, port) {
+			exists, err := ip.Exists(placement.table(), placement.chain(), args...)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				if err := placement.add(ip, args); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hasIPTablesChain checks whether the dnsmasq iptables chain exists, with ipv6
+// also the ip6tables one
+func hasIPTablesChain(interfaceName string, port int, ipv6 bool, placement ipTablesPlacement) (bool, error) {
+	if err := validateInterfaceName(interfaceName); err != nil {
+		return false, err
+	}
+	for _, protocol := range firewallProtocols(ipv6) {
+		ip, err := newIPTables(protocol)
+		if err != nil {
+			return false, err
+		}
+		for _, args := range ruleArgs(interfaceName, port) {
+			exists, err := ip.Exists(placement.table(), placement.chain(), args...)
+			if err != nil || !exists {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// probeIPTables checks that iptables works and the chain of the rules is
+// accessible, so firewall problems are reported before anything is set up
+func probeIPTables(placement ipTablesPlacement) error {
+	ip, err := newIPTables(iptables.ProtocolIPv4)
+	if err != nil {
+		return errors.Wrapf(ErrFirewallUnavailable, "can't initialize iptables (%v)", err)
+	}
+	exists, err := ip.ChainExists(placement.table(), placement.chain())
+	if err != nil {
+		return errors.Wrapf(ErrFirewallUnavailable, "can't access %s table (%v)", placement.table(), err)
+	}
+	if !exists {
+		return errors.Wrapf(ErrFirewallUnavailable, "%s table has no %s chain", placement.table(), placement.chain())
+	}
+	return nil
+}
+
+// deleteIPTablesChain deletes dnsmasq iptables chain, with ipv6 also the
+// ip6tables one
+func deleteIPTablesChain(interfaceName string, port int, ipv6 bool, placement ipTablesPlacement) error {
+	if err := validateInterfaceName(interfaceName); err != nil {
+		return err
+	}
+	for _, protocol := range firewallProtocols(ipv6) {
+		ip, err := newIPTables(protocol)
+		if err != nil {
+			return err
+		}
+		for _, args := range ruleArgs(interfaceName, port) {
+			if err := ip.DeleteIfExists(placement.table(), placement.chain(), args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateInterfaceName checks that the interface name is valid for the kernel,
+// otherwise iptables rejects the rule with a confusing error or a malformed name
+// ends up in the rules and the network files. The kernel limits the length and
+// rejects ".", "..", "/", ":" and whitespace.
+func validateInterfaceName(interfaceName string) error {
+	if interfaceName == "" {
+		return errors.Errorf("empty interface name")
+	}
+	if len(interfaceName) > maxInterfaceNameLength {
+		return errors.Errorf("interface name %q is longer than %d characters", interfaceName, maxInterfaceNameLength)
+	}
+	if interfaceName == "." || interfaceName == ".." {
+		return errors.Errorf("invalid interface name %q", interfaceName)
+	}
+	for _, r := range interfaceName {
+		if r == '/' || r == ':' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return errors.Errorf("interface name %q contains invalid character %q", interfaceName, r)
+		}
+	}
+	return nil
+}
+
+// nfTables is the subset of the nftables operations used by the plugin
+type nfTables interface {
+	ListTables() ([]*nftables.Table, error)
+	AddTable(t *nftables.Table) *nftables.Table
+	AddChain(c *nftables.Chain) *nftables.Chain
+	GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error)
+	AddRule(r *nftables.Rule) *nftables.Rule
+	DelRule(r *nftables.Rule) error
+	Flush() error
+}
+
+// newNFTables creates the nftables connection, it is replaced in tests
+var newNFTables = func() (nfTables, error) {
+	return nftables.New()
+}
+
+// nftTable is the table of the plugin rules, the inet family covers both IPv4
+// and IPv6
+var nftTable = &nftables.Table{Name: "dnsname", Family: nftables.TableFamilyINet}
+
+// nftChain returns the chain of the plugin rules hooked to input. The policy
+// is accept, so the chain doesn't affect the traffic not matched by the rules.
+func nftChain() *nftables.Chain {
+	policy := nftables.ChainPolicyAccept
+	return &nftables.Chain{
+		Name:     "input",
+		Table:    nftTable,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	}
+}
+
+// nfTablesFirewall adds the rules into the input chain of the plugin nftables
+// table, for the hosts without iptables
+type nfTablesFirewall struct {
+	ipv6 bool
+}
+
+func (f nfTablesFirewall) ensureAllow(iface string, port int) error {
+	if err := validateInterfaceName(iface); err != nil {
+		return err
+	}
+	nft, err := newNFTables()
+	if err != nil {
+		return err
+	}
+	// adding the existing table or chain doesn't fail, so they are reused
+	nft.AddTable(nftTable)
+	chain := nft.AddChain(nftChain())
+	if err := nft.Flush(); err != nil {
+		return err
+	}
+	existing, err := nft.GetRules(nftTable, chain)
+	if err != nil {
+		return err
+	}
+	// each rule is checked separately to repair the partially applied rules
+	for _, rule := range nftRules(iface, port, f.ipv6) {
+		if findNFTRule(existing, rule) == nil {
+			nft.AddRule(rule)
+		}
+	}
+	return nft.Flush()
+}
+
+func (f nfTablesFirewall) removeAllow(iface string, port int) error {
+	if err := validateInterfaceName(iface); err != nil {
+		return err
+	}
+	nft, err := newNFTables()
+	if err != nil {
+		return err
+	}
+	existing, err := listNFTRules(nft)
+	if err != nil {
+		return err
+	}
+	// the table and the chain are shared by the networks, so they are kept
+	for _, rule := range nftRules(iface, port, f.ipv6) {
+		if found := findNFTRule(existing, rule); found != nil {
+			if err := nft.DelRule(found); err != nil {
+				return err
+			}
+		}
+	}
+	return nft.Flush()
+}
+
+func (f nfTablesFirewall) hasAllow(iface string, port int) (bool, error) {
+	if err := validateInterfaceName(iface); err != nil {
+		return false, err
+	}
+	nft, err := newNFTables()
+	if err != nil {
+		return false, err
+	}
+	existing, err := listNFTRules(nft)
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range nftRules(iface, port, f.ipv6) {
+		if findNFTRule(existing, rule) == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (f nfTablesFirewall) probe() error {
+	nft, err := newNFTables()
+	if err != nil {
+		return errors.Wrapf(ErrFirewallUnavailable, "can't initialize nftables (%v)", err)
+	}
+	if _, err := nft.ListTables(); err != nil {
+		return errors.Wrapf(ErrFirewallUnavailable, "can't list nftables tables (%v)", err)
+	}
+	return nil
+}
+
+// listNFTRules returns the rules of the plugin chain, no rules are returned if
+// the plugin table doesn't exist
+func listNFTRules(nft nfTables) ([]*nftables.Rule, error) {
+	tables, err := nft.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		if table.Name == nftTable.Name && table.Family == nftTable.Family {
+			return nft.GetRules(nftTable, nftChain())
+		}
+	}
+	return nil, nil
+}
+
+// findNFTRule finds the rule among the existing ones by the rule comment
+func findNFTRule(existing []*nftables.Rule, rule *nftables.Rule) *nftables.Rule {
+	for _, r := range existing {
+		if bytes.Equal(r.UserData, rule.UserData) {
+			return r
+		}
+	}
+	return nil
+}
+
+// nftRules returns the nftables rules accepting the DNS queries to the port on
+// the network interface, one per protocol. Without ipv6 only the IPv4 queries
+// are matched. The rules are identified by the comment.
+func nftRules(iface string, port int, ipv6 bool) []*nftables.Rule {
+	rules := make([]*nftables.Rule, 0, len(ruleProtocols))
+	for _, protocol := range ruleProtocols {
+		var exprs []expr.Any
+		if !ipv6 {
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+			)
+		}
+		l4proto := byte(unix.IPPROTO_UDP)
+		if protocol == "tcp" {
+			l4proto = unix.IPPROTO_TCP
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: nftIfName(iface)},
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+			// the destination port is at offset 2 of both UDP and TCP headers
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port))},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		)
+		rules = append(rules, &nftables.Rule{
+			Table:    nftTable,
+			Chain:    nftChain(),
+			Exprs:    exprs,
+			UserData: nftComment(fmt.Sprintf("dnsname %s %s dport %d", iface, protocol, port)),
+		})
+	}
+	return rules
+}
+
+// nftIfName returns the interface name padded as the kernel compares it
+func nftIfName(iface string) []byte {
+	name := make([]byte, unix.IFNAMSIZ)
+	copy(name, iface)
+	return name
+}
+
+// nftComment encodes the rule comment in the user data format of the nft tool
+func nftComment(comment string) []byte {
+	// NFTNL_UDATA_RULE_COMMENT type, length and the NUL terminated value
+	return append([]byte{0, byte(len(comment) + 1)}, append([]byte(comment), 0)...)
+}
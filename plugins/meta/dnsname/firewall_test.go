@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// fakeNFTables applies the changes immediately, the rules are shared by all
+// connections
+type fakeNFTables struct {
+	tables []*nftables.Table
+	rules  []*nftables.Rule
+	handle uint64
+}
+
+func newFakeNFTables(t *testing.T) *fakeNFTables {
+	fake := &fakeNFTables{}
+	origNewNFTables := newNFTables
+	newNFTables = func() (nfTables, error) {
+		return fake, nil
+	}
+	t.Cleanup(func() { newNFTables = origNewNFTables })
+	return fake
+}
+
+func (f *fakeNFTables) ListTables() ([]*nftables.Table, error) {
+	return f.tables, nil
+}
+
+func (f *fakeNFTables) AddTable(t *nftables.Table) *nftables.Table {
+	for _, table := range f.tables {
+		if table.Name == t.Name && table.Family == t.Family {
+			return t
+		}
+	}
+	f.tables = append(f.tables, t)
+	return t
+}
+
+func (f *fakeNFTables) AddChain(c *nftables.Chain) *nftables.Chain {
+	return c
+}
+
+func (f *fakeNFTables) GetRules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	if len(f.tables) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return f.rules, nil
+}
+
+func (f *fakeNFTables) AddRule(r *nftables.Rule) *nftables.Rule {
+	f.handle++
+	r.Handle = f.handle
+	f.rules = append(f.rules, r)
+	return r
+}
+
+func (f *fakeNFTables) DelRule(r *nftables.Rule) error {
+	for i, rule := range f.rules {
+		if rule.Handle == r.Handle {
+			f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			return nil
+		}
+	}
+	return os.ErrNotExist
+}
+
+func (f *fakeNFTables) Flush() error {
+	return nil
+}
+
+func TestNFTRules(t *testing.T) {
+	rules := nftRules("cni0", 5353, true)
+	if len(rules) != 2 {
+		t.Fatalf("Wrong number of rules: %d", len(rules))
+	}
+	for i, protocol := range []byte{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+		exprs := rules[i].Exprs
+		if len(exprs) != 7 {
+			t.Fatalf("Wrong number of expressions: %d", len(exprs))
+		}
+		if cmp := exprs[1].(*expr.Cmp); !bytes.Equal(cmp.Data, []byte("cni0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")) {
+			t.Errorf("Wrong interface name: %q", cmp.Data)
+		}
+		if cmp := exprs[3].(*expr.Cmp); !bytes.Equal(cmp.Data, []byte{protocol}) {
+			t.Errorf("Wrong protocol: %v", cmp.Data)
+		}
+		if cmp := exprs[5].(*expr.Cmp); !bytes.Equal(cmp.Data, []byte{0x14, 0xe9}) {
+			t.Errorf("Wrong port: %v", cmp.Data)
+		}
+		if verdict := exprs[6].(*expr.Verdict); verdict.Kind != expr.VerdictAccept {
+			t.Errorf("Wrong verdict: %v", verdict.Kind)
+		}
+		if rules[i].Table.Name != "dnsname" || rules[i].Chain.Name != "input" || *rules[i].Chain.Hooknum != *nftables.ChainHookInput {
+			t.Errorf("Wrong rule chain: %+v", rules[i].Chain)
+		}
+	}
+	if bytes.Equal(rules[0].UserData, rules[1].UserData) {
+		t.Error("Rules should have different comments")
+	}
+	if !bytes.Equal(rules[0].UserData, []byte("\x00\x1cdnsname cni0 udp dport 5353\x00")) {
+		t.Errorf("Wrong rule comment: %q", rules[0].UserData)
+	}
+
+	// without IPv6 only the IPv4 queries are accepted
+	rules = nftRules("cni0", 53, false)
+	if cmp := rules[0].Exprs[1].(*expr.Cmp); len(rules[0].Exprs) != 9 || !bytes.Equal(cmp.Data, []byte{unix.NFPROTO_IPV4}) {
+		t.Errorf("IPv4 rule should match the IPv4 family: %+v", rules[0].Exprs)
+	}
+}
+
+func TestNFTablesFirewall(t *testing.T) {
+	fake := newFakeNFTables(t)
+	fw := newFirewall(firewallNFTables, true)
+	if err := fw.probe(); err != nil {
+		t.Errorf("Probe should succeed: %v", err)
+	}
+	if err := fw.removeAllow("cni0", defaultDNSPort); err != nil {
+		t.Errorf("Removal without table should succeed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := fw.ensureAllow("cni0", defaultDNSPort); err != nil {
+			t.Fatalf("Can't add rules: %v", err)
+		}
+	}
+	if len(fake.rules) != 2 {
+		t.Errorf("Rules should be added once, got %d", len(fake.rules))
+	}
+	if err := fw.ensureAllow("cni1", defaultDNSPort); err != nil {
+		t.Fatalf("Can't add rules: %v", err)
+	}
+	if err := fw.removeAllow("cni0", defaultDNSPort); err != nil {
+		t.Fatalf("Can't remove rules: %v", err)
+	}
+	if exists, err := fw.hasAllow("cni0", defaultDNSPort); err != nil || exists {
+		t.Errorf("Rules of cni0 should be removed: %v", err)
+	}
+	if exists, err := fw.hasAllow("cni1", defaultDNSPort); err != nil || !exists {
+		t.Errorf("Rules of cni1 should be kept: %v", err)
+	}
+	if err := fw.ensureAllow("cni-podman012345", defaultDNSPort); err == nil {
+		t.Error("Over-length interface name should be rejected")
+	}
+}
+
+func TestNetNSFirewall(t *testing.T) {
+	fake := newFakeIPTables(t)
+	var (
+		inNetNS bool
+		paths   []string
+	)
+	origWithNetNS := withNetNS
+	withNetNS = func(path string, fn func() error) error {
+		paths = append(paths, path)
+		inNetNS = true
+		defer func() { inNetNS = false }()
+		return fn()
+	}
+	t.Cleanup(func() { withNetNS = origWithNetNS })
+	fakeNewIPTables := newIPTables
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		if !inNetNS {
+			t.Error("iptables should be used in the network namespace")
+		}
+		return fakeNewIPTables(protocol)
+	}
+
+	conf := dnsNameFile{NetworkInterface: "cni0", Netns: "dns", DisableIPv6Firewall: true}
+	fw := conf.firewall()
+	if err := fw.ensureAllow(conf.NetworkInterface, conf.port()); err != nil {
+		t.Fatalf("Can't add rules: %v", err)
+	}
+	if exists, err := fw.hasAllow(conf.NetworkInterface, conf.port()); err != nil || !exists {
+		t.Errorf("Rules should exist in the network namespace: %v", err)
+	}
+	if err := fw.removeAllow(conf.NetworkInterface, conf.port()); err != nil {
+		t.Fatalf("Can't remove rules: %v", err)
+	}
+	if len(fake.rules) != 0 {
+		t.Errorf("Rules are not removed: %v", fake.rules)
+	}
+	for _, path := range paths {
+		if path != "/var/run/netns/dns" {
+			t.Errorf("Wrong network namespace path: %s", path)
+		}
+	}
+	if len(paths) != 3 {
+		t.Errorf("Each operation should enter the network namespace, got %d", len(paths))
+	}
+
+	// without the namespace the rules are added in the current one
+	paths = nil
+	newIPTables = fakeNewIPTables
+	conf = dnsNameFile{NetworkInterface: "cni0", DisableIPv6Firewall: true}
+	if err := conf.firewall().ensureAllow(conf.NetworkInterface, conf.port()); err != nil {
+		t.Fatalf("Can't add rules: %v", err)
+	}
+	if len(paths) != 0 {
+		t.Error("Network namespace should not be entered")
+	}
+	if (dnsNameFile{Netns: "/run/netns/dns"}).netnsPath() != "/run/netns/dns" {
+		t.Error("Network namespace path should be kept")
+	}
+}
+
+func TestDisableFirewall(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	origNewIPTables, origNewNFTables := newIPTables, newNFTables
+	t.Cleanup(func() { newIPTables, newNFTables = origNewIPTables, origNewNFTables })
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		t.Error("iptables should not be used")
+		return nil, errors.New("iptables not found")
+	}
+	newNFTables = func() (nfTables, error) {
+		t.Error("nftables should not be used")
+		return nil, errors.New("nftables not found")
+	}
+	for _, backend := range []string{firewallIPTables, firewallNFTables} {
+		conf := dnsNameFile{
+			AddOnHostsFile:   makePath("test", hostsFileName),
+			Binary:           fakeDNSMasq(t, makePath("test", pidFileName), ""),
+			ConfigFile:       makePath("test", confFileName),
+			Domain:           "test.org",
+			NetworkInterface: "lo",
+			PidFile:          makePath("test", pidFileName),
+			InterfaceFile:    makePath("test", interfaceFileName),
+			FirewallBackend:  backend,
+			DisableFirewall:  true,
+		}
+		if err := conf.firewall().probe(); err != nil {
+			t.Fatalf("Can't probe firewall: %v", err)
+		}
+		if err := setupNetwork(conf); err != nil {
+			t.Fatalf("Can't set up network: %v", err)
+		}
+		if _, err := conf.addPodEntry(PodEntry{Name: "pod1", IPs: []*net.IPNet{{IP: net.IP{127, 0, 0, 2}}}}); err != nil {
+			t.Fatalf("Can't add entry: %v", err)
+		}
+		if _, err := os.Stat(conf.ConfigFile); err != nil {
+			t.Errorf("dnsmasq config should be written: %v", err)
+		}
+		if exists, err := conf.hasPodEntry("pod1"); err != nil || !exists {
+			t.Errorf("Pod entry should be added: %v", err)
+		}
+		if err := cleanUp("pod1", conf, false); err != nil {
+			t.Fatalf("Can't clean up: %v", err)
+		}
+	}
+}
@@ -28,10 +28,12 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
@@ -43,14 +45,16 @@ import (
 )
 
 func cleanUp(podname string, dnsNameConf dnsNameFile, multiDomain bool) error {
-	if err := deleteIPTablesChain(dnsNameConf.NetworkInterface); err != nil {
-		return err
-	}
-	shouldHUP, err := removeFromFile(filepath.Join(filepath.Dir(dnsNameConf.PidFile), hostsFileName), podname)
+	shouldHUP, confChanged, err := dnsNameConf.removePodEntry(podname)
 	if err != nil {
 		return err
 	}
 	if !shouldHUP {
+		// the firewall rule is shared by all pods of the network, so it is
+		// removed only with the last pod
+		if err := dnsNameConf.firewall().removeAllow(dnsNameConf.NetworkInterface, dnsNameConf.port()); err != nil {
+			return err
+		}
 		// if there are no hosts, we should just stop the dnsmasq instance to not take
 		// system resources
 		nameservers, err := getInterfaceAddresses(dnsNameConf)
@@ -65,24 +69,85 @@ func cleanUp(podname string, dnsNameConf dnsNameFile, multiDomain bool) error {
 		if err := dnsNameConf.stop(); err != nil {
 			return err
 		}
+		if err := dnsNameConf.removeSnapshot(); err != nil {
+			logrus.Errorf("unable to remove network state snapshot: %v", err)
+		}
 		// remove netwoks dir
 		if err := os.RemoveAll(filepath.Dir(dnsNameConf.PidFile)); err != nil {
 			return err
 		}
 		return nil
 	}
-	// Now we need to HUP
-	return dnsNameConf.hup()
+	// Now we need to reload
+	if err := dnsNameConf.reload(confChanged); err != nil {
+		return err
+	}
+	if err := dnsNameConf.persistState(); err != nil {
+		logrus.Errorf("unable to persist network state: %v", err)
+	}
+	return nil
+}
+
+// setupNetwork creates the network state or recreates the parts removed by the
+// teardown of the last pod of the network. It must be called under the lock.
+func setupNetwork(dnsNameConf dnsNameFile) error {
+	if err := claimInterface(dnsNameConf); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dnsNameConf.PidFile), 0700); err != nil {
+		return err
+	}
+	if err := checkForDNSMasqConfFile(dnsNameConf); err != nil {
+		return err
+	}
+	if err := dnsNameConf.save(); err != nil {
+		return err
+	}
+	return dnsNameConf.firewall().ensureAllow(dnsNameConf.NetworkInterface, dnsNameConf.port())
+}
+
+// checkNetwork verifies that the state created by ADD for the pod is in place,
+// so the runtime can re-ADD the pod on error. It must be called under the lock.
+func checkNetwork(dnsNameConf dnsNameFile, podname string) error {
+	// Ensure the configuration matches the network configuration
+	if err := verifyDNSMasqConfig(dnsNameConf); err != nil {
+		return err
+	}
+	// Ensure the dnsmasq instance is running
+	if isRunning, _ := dnsNameConf.isRunning(); !isRunning {
+		return errors.Errorf("dnsmasq instance not running")
+	}
+	if err := probeDNSMasq(dnsNameConf); err != nil {
+		return err
+	}
+	exists, err := dnsNameConf.firewall().hasAllow(dnsNameConf.NetworkInterface, dnsNameConf.port())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Errorf("firewall rules of interface %s are missing", dnsNameConf.NetworkInterface)
+	}
+	exists, err = dnsNameConf.hasPodEntry(podname)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Errorf("records of pod %s are missing", podname)
+	}
+	return nil
 }
 
 func cmdAdd(args *skel.CmdArgs) (err error) {
 	if err := findDNSMasq(); err != nil {
-		return ErrBinaryNotFound
+		return err
 	}
 	netConf, result, podname, err := parseConfig(args.StdinData, args.Args)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse config")
 	}
+	if err := setupLogging(netConf.PluginLogFile); err != nil {
+		return err
+	}
 	if netConf.PrevResult == nil {
 		return errors.Errorf("must be called as chained plugin")
 	}
@@ -90,27 +155,33 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 	if err != nil {
 		return err
 	}
-	dnsNameConf, err := newDNSMasqFile(netConf.DomainName, result.Interfaces[0].Name, netConf.Name, netConf.MultiDomain)
+	dnsNameConf, err := newDNSMasqFileFromConf(netConf, result.Interfaces[0].Name)
 	if err != nil {
 		return err
 	}
-	domainBaseDir := filepath.Dir(dnsNameConf.PidFile)
-	// Check if the configuration file directory exists, else make it
-	if _, err := os.Stat(domainBaseDir); os.IsNotExist(err) {
-		if makeDirErr := os.MkdirAll(domainBaseDir, 0700); makeDirErr != nil {
-			return makeDirErr
-		}
+	if err := dnsNameConf.firewall().probe(); err != nil {
+		return err
 	}
+	// Check if the configuration directory exists, else make it. The network
+	// directory is made under the lock as it is removed by the teardown.
+	if err := os.MkdirAll(dnsNameConfPath(), 0700); err != nil {
+		return err
+	}
+	// the coalesced sighups are sent after the lock is released
+	defer flushHUPs(time.Duration(netConf.LockTimeout) * time.Second)
 	// we use the configuration directory for our locking mechanism but read/write and hup
 	lock, err := getLock(dnsNameConfPath())
 	if err != nil {
 		return err
 	}
-	if err := lock.acquire(); err != nil {
+	if err := lock.acquireWithTimeout(time.Duration(netConf.LockTimeout) * time.Second); err != nil {
 		return err
 	}
 	defer func() {
-		if err != nil {
+		// the interface belongs to another network or server, or the name to
+		// another pod, their state must not be touched
+		if err != nil && !errors.Is(err, ErrInterfaceInUse) && !errors.Is(err, ErrForeignDNSMasq) &&
+			!errors.Is(err, ErrHostExists) && !errors.Is(err, ErrAliasExists) {
 			if err := cleanUp(podname, dnsNameConf, netConf.MultiDomain); err != nil {
 				logrus.Errorf("Can't cleanup: %v", err)
 			}
@@ -119,27 +190,53 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
 		}
 	}()
-	if err := checkForDNSMasqConfFile(dnsNameConf); err != nil {
+	nameservers, err := getInterfaceAddresses(dnsNameConf)
+	if err != nil {
+		return err
+	}
+	// dnsmasq binds the interface addresses the same way as the check, so it
+	// can't start next to the detected server
+	if err := dnsNameConf.checkForeignDNSMasq(nameservers); err != nil {
 		return err
 	}
-	if err := addIPTablesChain(dnsNameConf.NetworkInterface); err != nil {
+	if err := setupNetwork(dnsNameConf); err != nil {
 		return err
 	}
-	aliases := netConf.RuntimeConfig.Aliases[netConf.Name]
-	if err := appendToFile(dnsNameConf.AddOnHostsFile, podname, aliases, ips); err != nil {
+	ttl, err := netConf.Args.ttl()
+	if err != nil {
+		return err
+	}
+	argAliases, err := netConf.Args.aliases()
+	if err != nil {
+		return err
+	}
+	aliases := mergeAliases(netConf.RuntimeConfig.Aliases[netConf.Name], argAliases)
+	aliases = markAbsoluteAliases(aliases, netConf.AbsoluteAliases)
+	if domain, _ := netConf.Args.domain(); domain != "" {
+		for i, alias := range aliases {
+			aliases[i] = qualifyName(alias, domain)
+		}
+	}
+	entry := PodEntry{
+		Name:    podname,
+		Aliases: aliases,
+		IPs:     ips,
+		TTL:     ttl,
+	}
+	if err := dnsNameConf.replaceStaticHosts(netConf.RuntimeConfig.StaticHosts); err != nil {
+		return err
+	}
+	confChanged, err := dnsNameConf.addPodEntry(entry)
+	if err != nil {
 		return err
 	}
 
 	if len(netConf.RemoteServers) > 0 {
-		if err := addRemoteServers(dnsNameConf.LocalServersConfFile, netConf.RemoteServers); err != nil {
+		if err := addRemoteServers(dnsNameConf.LocalServersConfFile, netConf.RemoteServers, dnsNameConf.fileMode()); err != nil {
 			return err
 		}
 	}
 
-	nameservers, err := getInterfaceAddresses(dnsNameConf)
-	if err != nil {
-		return err
-	}
 	if netConf.MultiDomain {
 		if isRunning, _ := dnsNameConf.isRunning(); !isRunning {
 			if err := addLocalServers(dnsNameConf, nameservers); err != nil {
@@ -147,10 +244,16 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 			}
 		}
 	}
-	// Now we need to HUP
-	if err := dnsNameConf.hup(); err != nil {
+	// Now we need to reload
+	if err := dnsNameConf.reload(confChanged); err != nil {
+		return err
+	}
+	if err := dnsNameConf.writeResolvConf(nameservers); err != nil {
 		return err
 	}
+	if err := dnsNameConf.persistState(); err != nil {
+		logrus.Errorf("unable to persist network state: %v", err)
+	}
 	// keep anything that was passed in already
 	nameservers = append(nameservers, result.DNS.Nameservers...)
 	result.DNS.Nameservers = nameservers
@@ -160,7 +263,7 @@ func cmdAdd(args *skel.CmdArgs) (err error) {
 
 func cmdDel(args *skel.CmdArgs) error {
 	if err := findDNSMasq(); err != nil {
-		return ErrBinaryNotFound
+		return err
 	}
 	netConf, result, podname, err := parseConfig(args.StdinData, args.Args)
 	if err != nil {
@@ -168,15 +271,20 @@ func cmdDel(args *skel.CmdArgs) error {
 	} else if result == nil {
 		return nil
 	}
-	dnsNameConf, err := newDNSMasqFile(netConf.DomainName, result.Interfaces[0].Name, netConf.Name, netConf.MultiDomain)
+	if err := setupLogging(netConf.PluginLogFile); err != nil {
+		return err
+	}
+	dnsNameConf, err := newDNSMasqFileFromConf(netConf, result.Interfaces[0].Name)
 	if err != nil {
 		return err
 	}
+	// the coalesced sighups are sent after the lock is released
+	defer flushHUPs(time.Duration(netConf.LockTimeout) * time.Second)
 	lock, err := getLock(dnsNameConfPath())
 	if err != nil {
 		return err
 	}
-	if err := lock.acquire(); err != nil {
+	if err := lock.acquireWithTimeout(time.Duration(netConf.LockTimeout) * time.Second); err != nil {
 		return err
 	}
 	defer func() {
@@ -189,26 +297,34 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func main() {
+	// maintenance commands are passed as arguments, CNI commands via environment
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "dnsname: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("dnsname"))
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
-	var (
-		conffiles []string
-	)
 	if err := findDNSMasq(); err != nil {
-		return ErrBinaryNotFound
+		return err
 	}
-	netConf, result, _, err := parseConfig(args.StdinData, args.Args)
+	netConf, result, podname, err := parseConfig(args.StdinData, args.Args)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse config")
 	}
+	if err := setupLogging(netConf.PluginLogFile); err != nil {
+		return err
+	}
 
 	// Ensure we have previous result.
 	if result == nil {
 		return errors.Errorf("Required prevResult missing")
 	}
-	dnsNameConf, err := newDNSMasqFile(netConf.DomainName, result.Interfaces[0].Name, netConf.Name, netConf.MultiDomain)
+	dnsNameConf, err := newDNSMasqFileFromConf(netConf, result.Interfaces[0].Name)
 	if err != nil {
 		return err
 	}
@@ -216,7 +332,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	if err := lock.acquire(); err != nil {
+	if err := lock.acquireWithTimeout(time.Duration(netConf.LockTimeout) * time.Second); err != nil {
 		return err
 	}
 	defer func() {
@@ -225,25 +341,7 @@ func cmdCheck(args *skel.CmdArgs) error {
 			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
 		}
 	}()
-	// Ensure the dnsmasq instance is running
-	if isRunning, _ := dnsNameConf.isRunning(); !isRunning {
-		return errors.Errorf("dnsmasq instance not running")
-	}
-	// Above will make sure the pidfile exists
-	files, err := ioutil.ReadDir(dnsNameConfPath())
-	if err != nil {
-		return err
-	}
-	for _, f := range files {
-		conffiles = append(conffiles, f.Name())
-	}
-	if !stringInSlice(hostsFileName, conffiles) {
-		return errors.Errorf("%s file missing from configuration", hostsFileName)
-	}
-	if !stringInSlice(confFileName, conffiles) {
-		return errors.Errorf("%s file missing from configuration", confFileName)
-	}
-	return nil
+	return checkNetwork(dnsNameConf, podname)
 }
 
 // stringInSlice is simple util to check for the presence of a string
@@ -260,6 +358,88 @@ func stringInSlice(s string, slice []string) bool {
 type podname struct {
 	types.CommonArgs
 	K8S_POD_NAME types.UnmarshallableString `json:"podname,omitempty"`
+	DNS_TTL      types.UnmarshallableString `json:"ttl,omitempty"`
+	DNS_ALIASES  types.UnmarshallableString `json:"aliases,omitempty"`
+	DNS_DOMAIN   types.UnmarshallableString `json:"domain,omitempty"`
+}
+
+// ttl returns the per-entry TTL passed in the CNI args, 0 if not set
+func (e podname) ttl() (int, error) {
+	if e.DNS_TTL == "" {
+		return 0, nil
+	}
+	ttl, err := strconv.Atoi(string(e.DNS_TTL))
+	if err != nil || ttl < 0 {
+		return 0, errors.Errorf("invalid TTL %q", e.DNS_TTL)
+	}
+	return ttl, nil
+}
+
+// aliases returns the pod aliases passed in the CNI args. Runtimes forward the
+// aliases annotation either as a comma separated or as a JSON list.
+func (e podname) aliases() ([]string, error) {
+	value := strings.TrimSpace(string(e.DNS_ALIASES))
+	if value == "" {
+		return nil, nil
+	}
+	var aliases []string
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &aliases); err != nil {
+			return nil, errors.Wrapf(err, "invalid aliases %q", value)
+		}
+	} else {
+		aliases = strings.Split(value, ",")
+	}
+	result := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		alias = strings.TrimSpace(alias)
+		if err := validateHostName(alias); err != nil {
+			return nil, err
+		}
+		result = append(result, alias)
+	}
+	return result, nil
+}
+
+// domain returns the per-entry domain passed in the CNI args, empty if not set
+func (e podname) domain() (string, error) {
+	if e.DNS_DOMAIN == "" {
+		return "", nil
+	}
+	if err := validateHostName(string(e.DNS_DOMAIN)); err != nil {
+		return "", errors.Wrap(err, "invalid domain")
+	}
+	return strings.TrimSuffix(string(e.DNS_DOMAIN), "."), nil
+}
+
+// mergeAliases appends the aliases missing in aliases from extra
+func mergeAliases(aliases, extra []string) []string {
+	for _, alias := range extra {
+		if !stringInSlice(alias, aliases) {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
+}
+
+// validateHostName checks that name is a valid DNS host name, a trailing dot
+// marking a fully qualified name is allowed
+func validateHostName(name string) error {
+	trimmed := strings.TrimSuffix(name, ".")
+	if trimmed == "" || len(trimmed) > 253 {
+		return errors.Errorf("invalid host name %q", name)
+	}
+	for _, label := range strings.Split(trimmed, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.Errorf("invalid host name %q", name)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return errors.Errorf("invalid host name %q", name)
+			}
+		}
+	}
+	return nil
 }
 
 // parseConfig parses the supplied configuration (and prevResult) from stdin.
@@ -281,14 +461,81 @@ func parseConfig(stdin []byte, args string) (*DNSNameConf, *current.Result, stri
 			return nil, nil, "", errors.Wrap(err, "could not convert result to current version")
 		}
 	}
-	e := podname{}
+	// runtimes pass their own args, e.g. K8S_POD_NAMESPACE, which are ignored
+	// even without IgnoreUnknown
+	e := podname{CommonArgs: types.CommonArgs{IgnoreUnknown: true}}
 	if err := types.LoadArgs(args, &e); err != nil {
 		return nil, nil, "", err
 	}
-	return &conf, result, string(e.K8S_POD_NAME), nil
+	conf.Args = e
+	// entries with their own domain are written fully qualified so they are
+	// not expanded with the network domain
+	domain, err := e.domain()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return &conf, result, qualifyName(string(e.K8S_POD_NAME), domain), nil
 }
 
+// setupLogging directs the plugin logs to the log file, the dnsmasq logs are
+// configured separately in its configuration
+func setupLogging(logFile string) error {
+	if logFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed to open plugin log file")
+	}
+	logrus.SetOutput(f)
+	return nil
+}
+
+// findDNSMasq checks that the dnsmasq binary can be run before anything is
+// changed, so a missing dnsmasq doesn't leave a partially set up network
 func findDNSMasq() error {
-	_, err := exec.LookPath("dnsmasq")
+	_, err := findBinary("dnsmasq")
 	return err
 }
+
+// findBinary returns the path of the executable binary, the name without a
+// slash is looked up in PATH. Unlike exec.LookPath it tells the missing binary
+// from the file which is not executable.
+func findBinary(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, checkExecutable(name)
+	}
+	var notExecutable error
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		path := filepath.Join(dir, name)
+		err := checkExecutable(path)
+		if err == nil {
+			return path, nil
+		}
+		if errors.Cause(err) == ErrBinaryNotExecutable && notExecutable == nil {
+			notExecutable = err
+		}
+	}
+	if notExecutable != nil {
+		return "", notExecutable
+	}
+	return "", errors.Wrapf(ErrBinaryNotFound, "install %s or add its directory to PATH %q", name, os.Getenv("PATH"))
+}
+
+// checkExecutable checks that the file at path exists and is executable
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return errors.Wrapf(ErrBinaryNotFound, "%s doesn't exist", path)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+		return errors.Wrapf(ErrBinaryNotExecutable, "check the permissions of %s", path)
+	}
+	return nil
+}
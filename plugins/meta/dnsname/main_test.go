@@ -0,0 +1,570 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/pkg/errors"
+)
+
+// fakeIPTables keeps the rules of both protocols in the shared map
+type fakeIPTables struct {
+	rules map[string]bool
+	// positions records the insert positions of the rules, -1 if appended
+	positions map[string]int
+	protocol  iptables.Protocol
+}
+
+func newFakeIPTables(t *testing.T) *fakeIPTables {
+	fake := &fakeIPTables{rules: make(map[string]bool), positions: make(map[string]int)}
+	origNewIPTables := newIPTables
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		return &fakeIPTables{rules: fake.rules, positions: fake.positions, protocol: protocol}, nil
+	}
+	t.Cleanup(func() { newIPTables = origNewIPTables })
+	return fake
+}
+
+func (f *fakeIPTables) key(table, chain string, rulespec []string) string {
+	return fmt.Sprintf("%d/%s/%s/%s", f.protocol, table, chain, strings.Join(rulespec, " "))
+}
+
+func (f *fakeIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return f.rules[f.key(table, chain, rulespec)], nil
+}
+
+func (f *fakeIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	f.rules[f.key(table, chain, rulespec)] = true
+	f.positions[f.key(table, chain, rulespec)] = pos
+	return nil
+}
+
+func (f *fakeIPTables) Append(table, chain string, rulespec ...string) error {
+	f.rules[f.key(table, chain, rulespec)] = true
+	f.positions[f.key(table, chain, rulespec)] = -1
+	return nil
+}
+
+func (f *fakeIPTables) DeleteIfExists(table, chain string, rulespec ...string) error {
+	delete(f.rules, f.key(table, chain, rulespec))
+	return nil
+}
+
+func (f *fakeIPTables) ChainExists(table, chain string) (bool, error) {
+	return table == "filter" && chain == "INPUT", nil
+}
+
+func TestProbeIPTables(t *testing.T) {
+	newFakeIPTables(t)
+	if err := probeIPTables(ipTablesPlacement{}); err != nil {
+		t.Errorf("Probe should succeed: %v", err)
+	}
+	newIPTables = func(protocol iptables.Protocol) (ipTables, error) {
+		return nil, errors.New("iptables not found")
+	}
+	if err := probeIPTables(ipTablesPlacement{}); errors.Cause(err) != ErrFirewallUnavailable {
+		t.Errorf("Wrong probe error: %v", err)
+	}
+}
+
+func TestFindBinary(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "dnsmasq")
+	// the missing binary
+	_, err := findBinary(binary)
+	if errors.Cause(err) != ErrBinaryNotFound || !strings.Contains(err.Error(), binary+" doesn't exist") {
+		t.Errorf("Missing binary should be reported, got: %v", err)
+	}
+	t.Setenv("PATH", dir)
+	if _, err := findBinary("dnsmasq"); errors.Cause(err) != ErrBinaryNotFound || !strings.Contains(err.Error(), "install dnsmasq") {
+		t.Errorf("Binary missing in PATH should be reported, got: %v", err)
+	}
+	if err := findDNSMasq(); errors.Cause(err) != ErrBinaryNotFound {
+		t.Errorf("Missing dnsmasq should be reported, got: %v", err)
+	}
+	// the file which is not executable
+	if err := ioutil.WriteFile(binary, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatalf("Can't write binary: %v", err)
+	}
+	for _, name := range []string{binary, "dnsmasq"} {
+		_, err := findBinary(name)
+		if errors.Cause(err) != ErrBinaryNotExecutable || !strings.Contains(err.Error(), "check the permissions of "+binary) {
+			t.Errorf("Binary %s which is not executable should be reported, got: %v", name, err)
+		}
+	}
+	// the valid binary
+	if err := os.Chmod(binary, 0755); err != nil {
+		t.Fatalf("Can't change mode: %v", err)
+	}
+	for _, name := range []string{binary, "dnsmasq"} {
+		if path, err := findBinary(name); err != nil || path != binary {
+			t.Errorf("Binary %s should be found, got: %s, %v", name, path, err)
+		}
+	}
+	if err := findDNSMasq(); err != nil {
+		t.Errorf("dnsmasq should be found: %v", err)
+	}
+}
+
+func TestCleanUpKeepsIPTablesRule(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	fake := newFakeIPTables(t)
+	binary := fakeDNSMasq(t, makePath("test", pidFileName), "")
+	if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), "test"), 0700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	conf := dnsNameFile{
+		AddOnHostsFile:   makePath("test", hostsFileName),
+		Binary:           binary,
+		ConfigFile:       makePath("test", confFileName),
+		NetworkInterface: "lo",
+		PidFile:          makePath("test", pidFileName),
+	}
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte("127.0.0.2\tpod1\n127.0.0.3\tpod2\n"), 0644); err != nil {
+		t.Fatalf("Can't write hosts file: %v", err)
+	}
+	if err := addIPTablesChain(conf.NetworkInterface, conf.port(), true, ipTablesPlacement{}); err != nil {
+		t.Fatalf("Can't add iptables rule: %v", err)
+	}
+	if err := cleanUp("pod1", conf, false); err != nil {
+		t.Fatalf("Can't clean up: %v", err)
+	}
+	if len(fake.rules) != 4 {
+		t.Error("iptables rules should be kept while pods are left")
+	}
+	if err := cleanUp("pod2", conf, false); err != nil {
+		t.Fatalf("Can't clean up: %v", err)
+	}
+	if len(fake.rules) != 0 {
+		t.Error("iptables rule should be removed with the last pod")
+	}
+	if _, err := os.Stat(filepath.Dir(conf.PidFile)); !os.IsNotExist(err) {
+		t.Error("Network dir should be removed with the last pod")
+	}
+}
+
+func TestArgAliases(t *testing.T) {
+	testData := []struct {
+		value   string
+		aliases []string
+		err     bool
+	}{
+		{value: "", aliases: nil},
+		{value: "web,db", aliases: []string{"web", "db"}},
+		{value: " web , db.example. ", aliases: []string{"web", "db.example."}},
+		{value: `["web","db"]`, aliases: []string{"web", "db"}},
+		{value: `["web",`, err: true},
+		{value: "web,,db", err: true},
+		{value: "-web", err: true},
+		{value: "web_1", err: true},
+		{value: strings.Repeat("a", 64), err: true},
+	}
+
+	for _, item := range testData {
+		aliases, err := podname{DNS_ALIASES: types.UnmarshallableString(item.value)}.aliases()
+		if item.err {
+			if err == nil {
+				t.Errorf("Error expected for %q", item.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Can't parse aliases %q: %v", item.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(aliases, item.aliases) {
+			t.Errorf("Wrong aliases for %q: %v", item.value, aliases)
+		}
+	}
+}
+
+func TestParseConfigArgAliases(t *testing.T) {
+	conf, _, _, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "dnsname"}`),
+		"K8S_POD_NAME=pod1;DNS_ALIASES=web,db")
+	if err != nil {
+		t.Fatalf("Can't parse config: %v", err)
+	}
+	aliases, err := conf.Args.aliases()
+	if err != nil {
+		t.Fatalf("Can't parse aliases: %v", err)
+	}
+	if merged := mergeAliases([]string{"db", "cache"}, aliases); !reflect.DeepEqual(merged, []string{"db", "cache", "web"}) {
+		t.Errorf("Wrong merged aliases: %v", merged)
+	}
+}
+
+func TestArgAliasesRecord(t *testing.T) {
+	// the args passed by the runtime without IgnoreUnknown
+	args := "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0;K8S_POD_INFRA_CONTAINER_ID=0123456789abcdef;" +
+		"K8S_POD_UID=4a9e7c2e-5c1b-4e0a-9b0e-6f2d1c3b4a5e;DNS_ALIASES=db,cache"
+	conf, _, podname, err := parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "dnsname"}`), args)
+	if err != nil {
+		t.Fatalf("Can't parse config: %v", err)
+	}
+	if podname != "web-0" {
+		t.Errorf("Wrong pod name: %s", podname)
+	}
+	argAliases, err := conf.Args.aliases()
+	if err != nil {
+		t.Fatalf("Can't parse aliases: %v", err)
+	}
+	aliases := mergeAliases([]string{"web"}, argAliases)
+	testFile := filepath.Join(t.TempDir(), "hosts")
+	ips := []*net.IPNet{{IP: net.ParseIP("10.88.0.2")}}
+	if err := appendToFile(testFile, podname, aliases, ips, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	got, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(got) != "10.88.0.2\tweb-0\tweb\tdb\tcache\n" {
+		t.Errorf("Wrong record: %q", string(got))
+	}
+	// the arg aliases go through the duplicate detection
+	conf, _, podname, err = parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "dnsname"}`),
+		"K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-1;DNS_ALIASES=DB")
+	if err != nil {
+		t.Fatalf("Can't parse config: %v", err)
+	}
+	argAliases, err = conf.Args.aliases()
+	if err != nil {
+		t.Fatalf("Can't parse aliases: %v", err)
+	}
+	if err := appendToFile(testFile, podname, argAliases, []*net.IPNet{{IP: net.ParseIP("10.88.0.3")}}, defaultFileMode); !errors.Is(err, ErrAliasExists) {
+		t.Errorf("Duplicated arg alias should be rejected, got: %v", err)
+	}
+	// absent args
+	conf, _, _, err = parseConfig([]byte(`{"cniVersion": "1.0.0", "name": "test", "type": "dnsname"}`), "")
+	if err != nil {
+		t.Fatalf("Can't parse config: %v", err)
+	}
+	if aliases, err := conf.Args.aliases(); err != nil || aliases != nil {
+		t.Errorf("Absent args should have no aliases, got: %v, %v", aliases, err)
+	}
+}
+
+func TestAddRacesLastPodTeardown(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	fake := newFakeIPTables(t)
+	binary := fakeDNSMasq(t, makePath("test", pidFileName), "")
+	if err := os.MkdirAll(dnsNameConfPath(), 0700); err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	conf := dnsNameFile{
+		AddOnHostsFile:   makePath("test", hostsFileName),
+		Binary:           binary,
+		ConfigFile:       makePath("test", confFileName),
+		Domain:           "test.org",
+		NetworkInterface: "lo",
+		PidFile:          makePath("test", pidFileName),
+		InterfaceFile:    makePath("test", interfaceFileName),
+	}
+	withLock := func(f func() error) error {
+		lock, err := getLock(dnsNameConfPath())
+		if err != nil {
+			return err
+		}
+		if err := lock.acquire(); err != nil {
+			return err
+		}
+		defer lock.release()
+		return f()
+	}
+	add := func(podname string, ip byte) error {
+		return withLock(func() error {
+			if err := setupNetwork(conf); err != nil {
+				return err
+			}
+			if _, err := conf.addPodEntry(PodEntry{Name: podname, IPs: []*net.IPNet{{IP: net.IP{127, 0, 0, ip}}}}); err != nil {
+				return err
+			}
+			// the state removed by the teardown must be recreated
+			if _, err := os.Stat(conf.ConfigFile); err != nil {
+				return err
+			}
+			if len(fake.rules) != 4 {
+				return errors.New("iptables rules are missing")
+			}
+			return conf.reload(false)
+		})
+	}
+	del := func(podname string) error {
+		return withLock(func() error {
+			return cleanUp(podname, conf, false)
+		})
+	}
+
+	// pod1 is the last pod of the network, pod2 is added while it is torn down
+	errs := make(chan error, 2)
+	for i := 0; i < 20; i++ {
+		if err := add("pod1", 2); err != nil {
+			t.Fatalf("Can't add pod: %v", err)
+		}
+		go func() { errs <- del("pod1") }()
+		go func() { errs <- add("pod2", 3) }()
+		for j := 0; j < 2; j++ {
+			if err := <-errs; err != nil {
+				t.Fatalf("Concurrent add/del failed: %v", err)
+			}
+		}
+		entries, err := readHostEntries(conf.AddOnHostsFile)
+		if err != nil {
+			t.Fatalf("Can't read entries: %v", err)
+		}
+		if len(entries) != 1 || entries[0].Name != "pod2" {
+			t.Fatalf("Wrong entries: %+v", entries)
+		}
+		if err := del("pod2"); err != nil {
+			t.Fatalf("Can't delete pod: %v", err)
+		}
+		if len(fake.rules) != 0 {
+			t.Fatal("iptables rule should be removed with the last pod")
+		}
+	}
+}
+
+func TestIPTablesRules(t *testing.T) {
+	fake := newFakeIPTables(t)
+	expected := [][]string{
+		{"-i", "cni0", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "ACCEPT"},
+		{"-i", "cni0", "-p", "tcp", "-m", "tcp", "--dport", "53", "-j", "ACCEPT"},
+	}
+	if rules := ruleArgs("cni0", defaultDNSPort); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Wrong rules: %v", rules)
+	}
+	// partially applied rules are repaired
+	if err := fake.Insert("filter", "INPUT", 1, expected[0]...); err != nil {
+		t.Fatalf("Can't insert rule: %v", err)
+	}
+	if exists, _ := hasIPTablesChain("cni0", defaultDNSPort, false, ipTablesPlacement{}); exists {
+		t.Error("Partially applied rules should not be reported as existing")
+	}
+	if err := addIPTablesChain("cni0", defaultDNSPort, false, ipTablesPlacement{}); err != nil {
+		t.Fatalf("Can't add rules: %v", err)
+	}
+	for _, args := range expected {
+		if exists, _ := fake.Exists("filter", "INPUT", args...); !exists {
+			t.Errorf("Rule %v is missing", args)
+		}
+	}
+	// rules are removed even if only one is present
+	if err := fake.DeleteIfExists("filter", "INPUT", expected[1]...); err != nil {
+		t.Fatalf("Can't delete rule: %v", err)
+	}
+	if err := deleteIPTablesChain("cni0", defaultDNSPort, false, ipTablesPlacement{}); err != nil {
+		t.Fatalf("Can't delete rules: %v", err)
+	}
+	if len(fake.rules) != 0 {
+		t.Errorf("Rules are not removed: %v", fake.rules)
+	}
+}
+
+func TestIPTablesDualStack(t *testing.T) {
+	fake := newFakeIPTables(t)
+	if err := addIPTablesChain("cni0", defaultDNSPort, true, ipTablesPlacement{}); err != nil {
+		t.Fatalf("Can't add rules: %v", err)
+	}
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ip, _ := newIPTables(protocol)
+		for _, args := range ruleArgs("cni0", defaultDNSPort) {
+			if exists, _ := ip.Exists("filter", "INPUT", args...); !exists {
+				t.Errorf("Rule %v of protocol %v is missing", args, protocol)
+			}
+		}
+	}
+	if exists, _ := hasIPTablesChain("cni0", defaultDNSPort, true, ipTablesPlacement{}); !exists {
+		t.Error("Rules should exist")
+	}
+	if err := deleteIPTablesChain("cni0", defaultDNSPort, true, ipTablesPlacement{}); err != nil {
+		t.Fatalf("Can't delete rules: %v", err)
+	}
+	if len(fake.rules) != 0 {
+		t.Errorf("Rules are not removed: %v", fake.rules)
+	}
+	// IPv4 only network
+	if err := addIPTablesChain("cni0", defaultDNSPort, false, ipTablesPlacement{}); err != nil {
+		t.Fatalf("Can't add rules: %v", err)
+	}
+	if len(fake.rules) != 2 {
+		t.Errorf("Only IPv4 rules should be added: %v", fake.rules)
+	}
+}
+
+func TestIPTablesPlacement(t *testing.T) {
+	fake := newFakeIPTables(t)
+	args := ruleArgs("cni0", defaultDNSPort)
+	placement := ipTablesPlacement{Table: "mangle", Chain: "DNSNAME", Position: 3}
+	if err := addIPTablesChain("cni0", defaultDNSPort, false, placement); err != nil {
+		t.Fatalf("Can't add rules: %v", err)
+	}
+	for _, rule := range args {
+		if pos, ok := fake.positions[fake.key("mangle", "DNSNAME", rule)]; !ok || pos != 3 {
+			t.Errorf("Rule %v should be inserted at 3 into mangle DNSNAME, got %d", rule, pos)
+		}
+	}
+	if exists, _ := hasIPTablesChain("cni0", defaultDNSPort, false, placement); !exists {
+		t.Error("Rules should exist in the configured chain")
+	}
+	if exists, _ := hasIPTablesChain("cni0", defaultDNSPort, false, ipTablesPlacement{}); exists {
+		t.Error("Rules should not exist in the default chain")
+	}
+	if err := deleteIPTablesChain("cni0", defaultDNSPort, false, placement); err != nil {
+		t.Fatalf("Can't delete rules: %v", err)
+	}
+	if len(fake.rules) != 0 {
+		t.Errorf("Rules are not removed from the configured chain: %v", fake.rules)
+	}
+
+	placement = ipTablesPlacement{Chain: "DNSNAME", Append: true}
+	if err := addIPTablesChain("cni0", defaultDNSPort, false, placement); err != nil {
+		t.Fatalf("Can't add rules: %v", err)
+	}
+	for _, rule := range args {
+		if pos, ok := fake.positions[fake.key("filter", "DNSNAME", rule)]; !ok || pos != -1 {
+			t.Errorf("Rule %v should be appended to filter DNSNAME, got %d", rule, pos)
+		}
+	}
+	if err := (ipTablesPlacement{Position: 2, Append: true}).validate(); err == nil {
+		t.Error("Position with append should be rejected")
+	}
+	if err := (ipTablesPlacement{Position: -1}).validate(); err == nil {
+		t.Error("Negative position should be rejected")
+	}
+}
+
+func TestCheckNetwork(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	fake := newFakeIPTables(t)
+	binary, err := exec.LookPath("true")
+	if err != nil {
+		t.Fatalf("Can't find binary: %v", err)
+	}
+	answer := int32(1)
+	conf := dnsNameFile{
+		AddOnHostsFile:   makePath("test", hostsFileName),
+		Binary:           binary,
+		ConfigFile:       makePath("test", confFileName),
+		Domain:           "test.org",
+		NetworkInterface: "lo",
+		PidFile:          makePath("test", pidFileName),
+		InterfaceFile:    makePath("test", interfaceFileName),
+		// the fake responder stands for the instance answering the queries
+		ListenAddressesV4: []string{"127.0.0.1"},
+		DNSPort:           fakeDNSResponder(t, &answer),
+	}
+	if err := setupNetwork(conf); err != nil {
+		t.Fatalf("Can't set up network: %v", err)
+	}
+	if _, err := conf.addPodEntry(PodEntry{Name: "pod1", IPs: []*net.IPNet{{IP: net.IP{127, 0, 0, 2}}}}); err != nil {
+		t.Fatalf("Can't add entry: %v", err)
+	}
+	// the test process stands for the running instance
+	writePidFile := func() {
+		if err := ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+			t.Fatalf("Can't write pid file: %v", err)
+		}
+	}
+	writePidFile()
+	if err := checkNetwork(conf, "pod1"); err != nil {
+		t.Fatalf("Healthy network should pass the check: %v", err)
+	}
+
+	if err := checkNetwork(conf, "pod2"); err == nil || !strings.Contains(err.Error(), "pod2") {
+		t.Errorf("Missing pod records should be reported, got: %v", err)
+	}
+
+	rules := make(map[string]bool)
+	for rule := range fake.rules {
+		rules[rule] = true
+	}
+	fake.rules = make(map[string]bool)
+	if err := checkNetwork(conf, "pod1"); err == nil || !strings.Contains(err.Error(), "firewall") {
+		t.Errorf("Missing firewall rules should be reported, got: %v", err)
+	}
+	for rule := range rules {
+		fake.rules[rule] = true
+	}
+
+	atomic.StoreInt32(&answer, 0)
+	if err := checkNetwork(conf, "pod1"); err == nil || !strings.Contains(err.Error(), "doesn't answer") {
+		t.Errorf("Unresponsive instance should be reported, got: %v", err)
+	}
+	atomic.StoreInt32(&answer, 1)
+
+	if err := os.Remove(conf.PidFile); err != nil {
+		t.Fatalf("Can't remove pid file: %v", err)
+	}
+	if err := checkNetwork(conf, "pod1"); err == nil || !strings.Contains(err.Error(), "not running") {
+		t.Errorf("Stopped instance should be reported, got: %v", err)
+	}
+	writePidFile()
+
+	config, err := ioutil.ReadFile(conf.ConfigFile)
+	if err != nil {
+		t.Fatalf("Can't read config: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.ConfigFile, append(config, "log-queries\n"...), 0644); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if err := checkNetwork(conf, "pod1"); err == nil || !strings.Contains(err.Error(), "log-queries") {
+		t.Errorf("Changed config should be reported, got: %v", err)
+	}
+	if err := os.Remove(conf.ConfigFile); err != nil {
+		t.Fatalf("Can't remove config: %v", err)
+	}
+	if err := checkNetwork(conf, "pod1"); err == nil {
+		t.Error("Missing config should be reported")
+	}
+}
+
+func TestAddCollisionKeepsEntry(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	newFakeIPTables(t)
+	binary := fakeDNSMasq(t, makePath("test", pidFileName), "")
+	t.Setenv("PATH", filepath.Dir(binary)+":"+os.Getenv("PATH"))
+	add := func(podname, address string) error {
+		conf := fmt.Sprintf(`{
+  "cniVersion": "0.4.0",
+  "name": "test",
+  "type": "dnsname",
+  "domainName": "test.org",
+  "prevResult": {
+    "cniVersion": "0.4.0",
+    "interfaces": [{"name": "lo"}],
+    "ips": [{"version": "4", "interface": 0, "address": "%s/8"}]
+  }
+}`, address)
+		return cmdAdd(&skel.CmdArgs{
+			ContainerID: podname,
+			IfName:      "eth0",
+			Args:        "K8S_POD_NAME=" + podname,
+			StdinData:   []byte(conf),
+		})
+	}
+	if err := add("pod1", "127.0.0.2"); err != nil {
+		t.Fatalf("Can't add pod: %v", err)
+	}
+	// the colliding ADD fails without removing the entry of the name owner
+	if err := add("pod1", "127.0.0.3"); !errors.Is(err, ErrHostExists) {
+		t.Fatalf("Expected host exists error, got: %v", err)
+	}
+	entries, err := readHostEntries(makePath("test", hostsFileName))
+	if err != nil {
+		t.Fatalf("Can't read entries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "pod1" || !entries[0].IPs[0].IP.Equal(net.IP{127, 0, 0, 2}) {
+		t.Errorf("Entry of the first pod should be kept: %+v", entries)
+	}
+}
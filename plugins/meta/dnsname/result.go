@@ -44,14 +44,20 @@ func isInterfaceIndexSandox(idx int, r *current.Result) bool {
 }
 
 // getInterfaceAddresses gets all globalunicast IP addresses for a given
-// interface
+// interface, in the network namespace of the dnsmasq instance if configured
 func getInterfaceAddresses(nameConf dnsNameFile) ([]string, error) {
-	var nameservers []string
-	nic, err := net.InterfaceByName(nameConf.NetworkInterface)
-	if err != nil {
-		return nil, err
-	}
-	addrs, err := nic.Addrs()
+	var (
+		nameservers []string
+		addrs       []net.Addr
+	)
+	err := nameConf.inNetNS(func() error {
+		nic, err := net.InterfaceByName(nameConf.NetworkInterface)
+		if err != nil {
+			return err
+		}
+		addrs, err = nic.Addrs()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
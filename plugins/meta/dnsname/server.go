@@ -2,18 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // adds remote servers to existing dnsmasq instance
-func addRemoteServers(fileConfig string, remoteServers []string) error {
+func addRemoteServers(fileConfig string, remoteServers []string, mode os.FileMode) error {
 	curServerItems, err := readServerItems(fileConfig)
 	if err != nil && !os.IsNotExist(err) {
 		return err
@@ -26,14 +29,14 @@ func addRemoteServers(fileConfig string, remoteServers []string) error {
 		return nil
 	}
 
-	return writeServerItems(fileConfig, mergedServerItems)
+	return writeServerItems(fileConfig, mergedServerItems, mode)
 }
 
 // adds local servers to existing dnsmasq instances
 func addLocalServers(conf dnsNameFile, servers []string) error {
-	serverItems := serversToServerItems(conf.Domain, servers)
+	serverItems := serversToServerItems(conf.Domain, conf.serverAddresses(servers))
 	// write own servers to file
-	if err := writeServerItems(conf.OwnServersConfFile, serverItems); err != nil {
+	if err := writeServerItems(conf.OwnServersConfFile, serverItems, conf.fileMode()); err != nil {
 		return err
 	}
 
@@ -59,12 +62,12 @@ func addLocalServers(conf dnsNameFile, servers []string) error {
 		}
 	}
 	curServersItems, _ = removeServerItems(curServersItems, serverItems)
-	return writeServerItems(conf.LocalServersConfFile, curServersItems)
+	return writeServerItems(conf.LocalServersConfFile, curServersItems, conf.fileMode())
 }
 
 // removes local servers from existing dnsmasq instances
 func removeLocalServers(conf dnsNameFile, servers []string) error {
-	serverItems := serversToServerItems(conf.Domain, servers)
+	serverItems := serversToServerItems(conf.Domain, conf.serverAddresses(servers))
 	// walk through existing dnsmasq and remove local servers
 	curDir := filepath.Base(filepath.Dir(conf.LocalServersConfFile))
 	items, err := ioutil.ReadDir(filepath.Join(dnsNameConfPath()))
@@ -100,9 +103,11 @@ func addServersToInstance(networkName, domainName string, serverItems []string)
 		return nil, err
 	}
 	mergedServerItems, modified := mergeServerItems(curServerItems, serverItems)
-	// if server items modified, write them to the file
+	// if server items modified, write them to the file, the options of the
+	// instance aren't known, so the file keeps its mode
 	if modified {
-		if err := writeServerItems(conf.LocalServersConfFile, mergedServerItems); err != nil {
+		mode := existingFileMode(conf.LocalServersConfFile, defaultFileMode)
+		if err := writeServerItems(conf.LocalServersConfFile, mergedServerItems, mode); err != nil {
 			return nil, err
 		}
 		// if instance is running send hup signal to apply new configuration
@@ -145,9 +150,10 @@ func removeServersFromInstance(networkName string, serverItems []string) error {
 		return err
 	}
 	newServerItems, modified := removeServerItems(curServerItems, serverItems)
-	// if server items modified, write them to the file
+	// if server items modified, write them to the file keeping its mode
 	if modified {
-		if err := writeServerItems(conf.LocalServersConfFile, newServerItems); err != nil {
+		mode := existingFileMode(conf.LocalServersConfFile, defaultFileMode)
+		if err := writeServerItems(conf.LocalServersConfFile, newServerItems, mode); err != nil {
 			return err
 		}
 		// if instance is running send hup signal to apply new configuration
@@ -212,19 +218,76 @@ func readServerItems(fileName string) ([]string, error) {
 	return servers, scanner.Err()
 }
 
-// writes servers slice to file
-func writeServerItems(fileName string, servers []string) error {
+// writes servers slice to file with the given mode, the file is swapped in
+// atomically so dnsmasq never reads a partially written one
+func writeServerItems(fileName string, servers []string, mode os.FileMode) error {
 	sort.Strings(servers)
-	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0700)
+	var buf bytes.Buffer
+	for _, server := range servers {
+		fmt.Fprintln(&buf, server)
+	}
+	return writeFileAtomic(fileName, buf.Bytes(), mode)
+}
+
+// replaces the split DNS servers of the domain in the dnsmasq config with the
+// upstreams, no upstreams remove the domain. The config is changed under the
+// network lock. Returns true if the config was changed
+func setSplitDNSServers(fileConfig, domain string, upstreams []string, mode os.FileMode) (bool, error) {
+	domain, err := asciiDomain(hostNameKey(domain))
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer file.Close()
-	writer := bufio.NewWriter(file)
-	for _, server := range servers {
-		fmt.Fprintln(writer, server)
+	if err := validateDomain(domain); err != nil {
+		return false, err
+	}
+	if err := validateNameservers(upstreams); err != nil {
+		return false, err
+	}
+	lock, err := lockHostsFile(fileConfig)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", fileConfig, err)
+		}
+	}()
+	curServerItems, err := readServerItems(fileConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	newServerItems := serversToServerItems(domain, upstreams)
+	for _, item := range curServerItems {
+		if !isDomainInList(domain, []string{item}) {
+			newServerItems = append(newServerItems, item)
+		}
+	}
+	sort.Strings(newServerItems)
+	sort.Strings(curServerItems)
+	if strings.Join(newServerItems, "\n") == strings.Join(curServerItems, "\n") {
+		return false, nil
 	}
-	return writer.Flush()
+	return true, writeServerItems(fileConfig, newServerItems, mode)
+}
+
+// updateSplitDNS forwards the queries of the domain to the upstreams and
+// restarts the running dnsmasq instance if the servers are changed, as dnsmasq
+// reads the config files only on start. Returns true if the servers are changed
+func (d dnsNameFile) updateSplitDNS(domain string, upstreams []string) (bool, error) {
+	if d.LocalServersConfFile == "" {
+		return false, errors.Errorf("split DNS requires the multiDomain mode")
+	}
+	if hostNameKey(domain) == hostNameKey(d.Domain) {
+		return false, errors.Errorf("domain %s of the network can't be forwarded", domain)
+	}
+	changed, err := setSplitDNSServers(d.LocalServersConfFile, domain, upstreams, d.fileMode())
+	if err != nil || !changed {
+		return changed, err
+	}
+	if isRunning, _ := d.isRunning(); isRunning {
+		return true, d.restart()
+	}
+	return true, nil
 }
 
 // converts server IPs to dnsmasq
@@ -245,3 +308,164 @@ func remoteServersToServerItems(remoteServer []string) []string {
 	}
 	return serverItems
 }
+
+// adds host-record items for the pod entry to the dnsmasq config
+// generate items in dnsmasq config format: host-record=name[,alias...],ip[,ttl]
+// The identical records of the pod are accepted, so a retried ADD succeeds.
+// Returns true if the config was changed
+func addHostRecords(fileConfig string, entry PodEntry, mode os.FileMode) (bool, error) {
+	if fileConfig == "" {
+		return false, errors.Errorf("host records for %s require multi domain mode", entry.Name)
+	}
+	curServerItems, err := readServerItems(fileConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	names := append([]string{entry.Name}, entry.Aliases...)
+	hostRecordItems := make([]string, 0, len(entry.IPs))
+	for _, ip := range uniqueIPs(entry.IPs) {
+		item := fmt.Sprintf("host-record=%s,%s", strings.Join(names, ","), ip.IP.String())
+		if entry.TTL > 0 {
+			item += fmt.Sprintf(",%d", entry.TTL)
+		}
+		hostRecordItems = append(hostRecordItems, item)
+	}
+	if hasSameHostRecords(curServerItems, entry.Name, hostRecordItems) {
+		return false, nil
+	}
+	nameKeys := make(map[string]bool, len(names))
+	for _, name := range names {
+		nameKeys[hostNameKey(name)] = true
+	}
+	for _, item := range curServerItems {
+		for _, recordName := range hostRecordNames(item) {
+			if nameKeys[hostNameKey(recordName)] {
+				return false, hostExists(recordName)
+			}
+		}
+	}
+	mergedServerItems, _ := mergeServerItems(curServerItems, hostRecordItems)
+	return true, writeServerItems(fileConfig, mergedServerItems, mode)
+}
+
+// hasSameHostRecords checks whether the host-record items of the pod are exactly
+// the given ones
+func hasSameHostRecords(items []string, podname string, records []string) bool {
+	found := 0
+	for _, item := range items {
+		names := hostRecordNames(item)
+		if len(names) == 0 || hostNameKey(names[0]) != hostNameKey(podname) {
+			continue
+		}
+		if !stringInSlice(item, records) {
+			return false
+		}
+		found++
+	}
+	return found > 0 && found == len(records)
+}
+
+// removes host-record items of the pod from the dnsmasq config. Returns number
+// of host-record items left and true if the config was changed
+func removeHostRecords(fileConfig string, podname string, mode os.FileMode) (int, bool, error) {
+	if fileConfig == "" {
+		return 0, false, nil
+	}
+	curServerItems, err := readServerItems(fileConfig)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	newServerItems := make([]string, 0, len(curServerItems))
+	recordsLeft := 0
+	for _, item := range curServerItems {
+		names := hostRecordNames(item)
+		if len(names) > 0 && hostNameKey(names[0]) == hostNameKey(podname) {
+			continue
+		}
+		if len(names) > 0 {
+			recordsLeft++
+		}
+		newServerItems = append(newServerItems, item)
+	}
+	if len(newServerItems) == len(curServerItems) {
+		return recordsLeft, false, nil
+	}
+	return recordsLeft, true, writeServerItems(fileConfig, newServerItems, mode)
+}
+
+// returns host names of host-record item
+func hostRecordNames(item string) []string {
+	if !strings.HasPrefix(item, "host-record=") {
+		return nil
+	}
+	var names []string
+	for _, field := range strings.Split(strings.TrimPrefix(item, "host-record="), ",") {
+		// names are followed by addresses
+		if field == "" || net.ParseIP(field) != nil {
+			break
+		}
+		names = append(names, field)
+	}
+	return names
+}
+
+// adds ptr-record items for the IPs to the dnsmasq config
+// generate items in dnsmasq config format: ptr-record=reverse-name,target
+func addPTRRecords(fileConfig, target string, ips []*net.IPNet, mode os.FileMode) error {
+	if fileConfig == "" {
+		return errors.Errorf("reverse records for %s require multi domain mode", target)
+	}
+	curServerItems, err := readServerItems(fileConfig)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ptrRecordItems := make([]string, 0, len(ips))
+	for _, ip := range uniqueIPs(ips) {
+		ptrRecordItems = append(ptrRecordItems, fmt.Sprintf("ptr-record=%s,%s", reverseAddr(ip.IP), target))
+	}
+	mergedServerItems, modified := mergeServerItems(curServerItems, ptrRecordItems)
+	if !modified {
+		return nil
+	}
+	return writeServerItems(fileConfig, mergedServerItems, mode)
+}
+
+// removes ptr-record items pointing to the target from the dnsmasq config.
+// Returns true if the config was changed
+func removePTRRecords(fileConfig, target string, mode os.FileMode) (bool, error) {
+	curServerItems, err := readServerItems(fileConfig)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	newServerItems := make([]string, 0, len(curServerItems))
+	for _, item := range curServerItems {
+		if strings.HasPrefix(item, "ptr-record=") && strings.HasSuffix(item, ","+target) {
+			continue
+		}
+		newServerItems = append(newServerItems, item)
+	}
+	if len(newServerItems) == len(curServerItems) {
+		return false, nil
+	}
+	return true, writeServerItems(fileConfig, newServerItems, mode)
+}
+
+// returns the reverse lookup name of the IP address
+func reverseAddr(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	var buf strings.Builder
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&buf, "%x.%x.", ip16[i]&0xf, ip16[i]>>4)
+	}
+	buf.WriteString("ip6.arpa")
+	return buf.String()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
@@ -50,7 +51,7 @@ server=/local2/192.168.3.1
 	}
 
 	if err := addRemoteServers(filepath.Join(dnsNameConfPath(), "local3", localServersConfFileName),
-		[]string{"10.10.1.1", "10.10.2.1"}); err != nil {
+		[]string{"10.10.1.1", "10.10.2.1"}, defaultFileMode); err != nil {
 		t.Fatalf("Can't add remote servers: %v", err)
 	}
 
@@ -283,3 +284,189 @@ server=/net3/192.168.3.1
 		}
 	}
 }
+
+func TestHostRecords(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	if err := createNetwork("net1", "server=10.10.1.1\n", ""); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	fileConfig := filepath.Join(dnsNameConfPath(), "net1", localServersConfFileName)
+	entries := []PodEntry{
+		{Name: "pod1", Aliases: []string{"alias1"}, IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}}, TTL: 5},
+		{Name: "pod2", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}, TTL: 3600},
+	}
+	for _, entry := range entries {
+		if changed, err := addHostRecords(fileConfig, entry, defaultFileMode); err != nil || !changed {
+			t.Fatalf("Can't add host records: %v", err)
+		}
+	}
+	// retried ADD of the identical entry succeeds without changes
+	if changed, err := addHostRecords(fileConfig, entries[0], defaultFileMode); err != nil || changed {
+		t.Errorf("Identical host records should be accepted unchanged: %v", err)
+	}
+	if _, err := addHostRecords(fileConfig, PodEntry{Name: "pod1", Aliases: []string{"alias1"},
+		IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 9}}}, TTL: 5}, defaultFileMode); err == nil {
+		t.Error("Host records of the pod with another IP should be rejected")
+	}
+	if _, err := addHostRecords(fileConfig, PodEntry{Name: "POD2", IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 4}}}, TTL: 5}, defaultFileMode); err == nil {
+		t.Error("Host names differing in case only should collide")
+	}
+	if _, err := addHostRecords(fileConfig, PodEntry{Name: "pod4", Aliases: []string{"Alias1"},
+		IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 4}}}, TTL: 5}, defaultFileMode); err == nil {
+		t.Error("Aliases differing in case only should collide")
+	}
+	if _, err := addHostRecords(fileConfig, PodEntry{Name: "pod3", Aliases: []string{"alias1"},
+		IPs: []*net.IPNet{{IP: net.IP{192, 168, 0, 3}}}, TTL: 5}, defaultFileMode); err == nil {
+		t.Error("Host record should not be added due to unique host violation")
+	}
+	data, err := ioutil.ReadFile(fileConfig)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	expected := `host-record=pod1,alias1,192.168.0.1,5
+host-record=pod2,192.168.0.2,3600
+server=10.10.1.1
+`
+	if string(data) != expected {
+		t.Fatalf("Expected: %s got: %s", expected, string(data))
+	}
+	recordsLeft, modified, err := removeHostRecords(fileConfig, "pod1", defaultFileMode)
+	if err != nil {
+		t.Fatalf("Can't remove host records: %v", err)
+	}
+	if recordsLeft != 1 || !modified {
+		t.Errorf("Wrong remove result, records left: %d, modified: %v", recordsLeft, modified)
+	}
+	recordsLeft, modified, err = removeHostRecords(fileConfig, "pod1", defaultFileMode)
+	if err != nil {
+		t.Fatalf("Can't remove host records: %v", err)
+	}
+	if recordsLeft != 1 || modified {
+		t.Errorf("Wrong remove result, records left: %d, modified: %v", recordsLeft, modified)
+	}
+	data, err = ioutil.ReadFile(fileConfig)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	expected = `host-record=pod2,192.168.0.2,3600
+server=10.10.1.1
+`
+	if string(data) != expected {
+		t.Fatalf("Expected: %s got: %s", expected, string(data))
+	}
+}
+
+func TestPTRRecords(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	if err := createNetwork("net1", "", ""); err != nil {
+		t.Fatalf("Can't create network: %v", err)
+	}
+	fileConfig := filepath.Join(dnsNameConfPath(), "net1", localServersConfFileName)
+	if err := addPTRRecords(fileConfig, "pod1.net1.org", []*net.IPNet{
+		{IP: net.IP{192, 168, 0, 1}}, {IP: net.ParseIP("fd00::1")}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't add reverse records: %v", err)
+	}
+	if err := addPTRRecords(fileConfig, "pod2.net1.org", []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't add reverse records: %v", err)
+	}
+	data, err := ioutil.ReadFile(fileConfig)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	expected := `ptr-record=1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa,pod1.net1.org
+ptr-record=1.0.168.192.in-addr.arpa,pod1.net1.org
+ptr-record=2.0.168.192.in-addr.arpa,pod2.net1.org
+`
+	if string(data) != expected {
+		t.Fatalf("Expected: %s got: %s", expected, string(data))
+	}
+	removed, err := removePTRRecords(fileConfig, "pod1.net1.org", defaultFileMode)
+	if err != nil {
+		t.Fatalf("Can't remove reverse records: %v", err)
+	}
+	if !removed {
+		t.Error("Reverse records should be removed")
+	}
+	if data, err = ioutil.ReadFile(fileConfig); err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	expected = `ptr-record=2.0.168.192.in-addr.arpa,pod2.net1.org
+`
+	if string(data) != expected {
+		t.Fatalf("Expected: %s got: %s", expected, string(data))
+	}
+}
+
+func TestSplitDNS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		Binary:               fakeDNSMasq(t, filepath.Join(tmpDir, pidFileName), ""),
+		ConfigFile:           filepath.Join(tmpDir, confFileName),
+		Domain:               "net1.org",
+		LocalServersConfFile: filepath.Join(tmpDir, localServersConfFileName),
+		PidFile:              filepath.Join(tmpDir, pidFileName),
+	}
+	if _, err := conf.updateSplitDNS("corp.example", []string{"10.0.0.1", "10.0.0.2"}); err != nil {
+		t.Fatalf("Can't set split DNS: %v", err)
+	}
+	if _, err := conf.updateSplitDNS("Lab.Example", []string{"10.1.0.1"}); err != nil {
+		t.Fatalf("Can't set split DNS: %v", err)
+	}
+	checkServers := func(expected string) {
+		t.Helper()
+		data, err := ioutil.ReadFile(conf.LocalServersConfFile)
+		if err != nil {
+			t.Fatalf("Can't read servers: %v", err)
+		}
+		if string(data) != expected {
+			t.Errorf("Wrong servers: %q, expected: %q", string(data), expected)
+		}
+	}
+	checkServers("server=/corp.example/10.0.0.1\nserver=/corp.example/10.0.0.2\nserver=/lab.example/10.1.0.1\n")
+
+	if err := conf.start(); err != nil {
+		t.Fatalf("Can't start dnsmasq: %v", err)
+	}
+	t.Cleanup(func() { conf.stop() })
+	pid, err := ioutil.ReadFile(conf.PidFile)
+	if err != nil {
+		t.Fatalf("Can't read pid file: %v", err)
+	}
+	// the same servers don't restart the instance
+	if changed, err := conf.updateSplitDNS("corp.example", []string{"10.0.0.2", "10.0.0.1"}); err != nil || changed {
+		t.Errorf("Servers should not change: %v", err)
+	}
+	if newPid, err := ioutil.ReadFile(conf.PidFile); err != nil || string(newPid) != string(pid) {
+		t.Errorf("Instance should not be restarted: %v", err)
+	}
+	if changed, err := conf.updateSplitDNS("corp.example", []string{"10.0.0.3"}); err != nil || !changed {
+		t.Errorf("Servers should change: %v", err)
+	}
+	checkServers("server=/corp.example/10.0.0.3\nserver=/lab.example/10.1.0.1\n")
+	if newPid, err := ioutil.ReadFile(conf.PidFile); err != nil || string(newPid) == string(pid) {
+		t.Errorf("Instance should be restarted: %v", err)
+	}
+	// no upstreams remove the domain
+	if _, err := conf.updateSplitDNS("lab.example", nil); err != nil {
+		t.Fatalf("Can't remove split DNS: %v", err)
+	}
+	checkServers("server=/corp.example/10.0.0.3\n")
+
+	if _, err := conf.updateSplitDNS("net1.org", []string{"10.0.0.1"}); err == nil {
+		t.Error("Domain of the network should be rejected")
+	}
+	if _, err := conf.updateSplitDNS("corp.example", []string{"not-an-ip"}); err == nil {
+		t.Error("Invalid upstream should be rejected")
+	}
+	if _, err := conf.updateSplitDNS("bad domain", []string{"10.0.0.1"}); err == nil {
+		t.Error("Invalid domain should be rejected")
+	}
+	conf.LocalServersConfFile = ""
+	if _, err := conf.updateSplitDNS("corp.example", []string{"10.0.0.1"}); err == nil {
+		t.Error("Split DNS without multiDomain mode should be rejected")
+	}
+}
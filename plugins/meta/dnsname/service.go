@@ -1,24 +1,61 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/sys/unix"
 )
 
+var (
+	// pidFileTimeout is the time to wait for dnsmasq to write the pid file
+	pidFileTimeout = 2 * time.Second
+	// pidFilePollInterval is the interval of the pid file polling
+	pidFilePollInterval = 20 * time.Millisecond
+	// defaultStartRetryDelay is the delay before the first retry of the dnsmasq start
+	defaultStartRetryDelay = 100 * time.Millisecond
+	// maxStartRetryDelay caps the exponential backoff of the dnsmasq start
+	maxStartRetryDelay = 2 * time.Second
+	// dnsProbeTimeout is the time to wait for the answer to the probe query
+	dnsProbeTimeout = time.Second
+	// stopGracePeriod is the time dnsmasq is given to exit on SIGTERM before it is killed
+	stopGracePeriod = 2 * time.Second
+	// defaultReloadDebounce is the window the sighups of a burst of pod changes are coalesced in
+	defaultReloadDebounce = 250 * time.Millisecond
+)
+
+// reloadMaxDelayFactor bounds the delay of the coalesced sighup during continuous
+// pod changes to the multiple of the debounce window
+const reloadMaxDelayFactor = 8
+
+// execLimitedCommand is the internal command of the plugin binary starting
+// dnsmasq under the memory limit
+const execLimitedCommand = "exec-limited"
+
+// pendingHUPs are the sighups requested by the invocation, keyed by the pid file
+var pendingHUPs = map[string]hupRequest{}
+
 // newDNSMasqFile creates a new instance of a dnsNameFile
 func newDNSMasqFile(domainName, networkInterface, networkName string, multiDomain bool) (dnsNameFile, error) {
-	dnsMasqBinary, err := exec.LookPath("dnsmasq")
+	dnsMasqBinary, err := findBinary("dnsmasq")
 	if err != nil {
-		return dnsNameFile{}, errors.Errorf("the dnsmasq cni plugin requires the dnsmasq binary be in PATH")
+		return dnsNameFile{}, errors.Wrapf(err, "the dnsmasq cni plugin requires the dnsmasq binary be in PATH")
 	}
 	masqConf := dnsNameFile{
 		ConfigFile:       makePath(networkName, confFileName),
@@ -26,6 +63,7 @@ func newDNSMasqFile(domainName, networkInterface, networkName string, multiDomai
 		PidFile:          makePath(networkName, pidFileName),
 		NetworkInterface: networkInterface,
 		AddOnHostsFile:   makePath(networkName, hostsFileName),
+		InterfaceFile:    makePath(networkName, interfaceFileName),
 		Binary:           dnsMasqBinary,
 	}
 	if multiDomain {
@@ -35,16 +73,383 @@ func newDNSMasqFile(domainName, networkInterface, networkName string, multiDomai
 	return masqConf, nil
 }
 
+// newDNSMasqFileFromConf creates a new instance of a dnsNameFile for the given
+// network configuration
+func newDNSMasqFileFromConf(netConf *DNSNameConf, networkInterface string) (dnsNameFile, error) {
+	// the interface comes from the previous result, it is checked before it is
+	// used by the firewall and written into the network directory
+	if err := validateInterfaceName(networkInterface); err != nil {
+		return dnsNameFile{}, err
+	}
+	masqConf, err := newDNSMasqFile(netConf.DomainName, networkInterface, netConf.Name, netConf.MultiDomain)
+	if err != nil {
+		return dnsNameFile{}, err
+	}
+	// the first of the domains is the primary one if the domain name is not set
+	if masqConf.Domain == "" && len(netConf.Domains) > 0 {
+		masqConf.Domain = netConf.Domains[0]
+	}
+	masqConf.Domains = netConf.Domains
+	masqConf.InterfaceNames = netConf.InterfaceNames
+	masqConf.Wildcards = netConf.Wildcards
+	masqConf.UseHostsFile = netConf.UseHostsFile
+	masqConf.DisableExpandHosts = netConf.DisableExpandHosts
+	masqConf.ExceptInterfaces = netConf.ExceptInterfaces
+	masqConf.ConfigChecksum = netConf.ConfigChecksum
+	if netConf.LockTimeout < 0 {
+		return dnsNameFile{}, errors.Errorf("invalid lock timeout %d", netConf.LockTimeout)
+	}
+	if netConf.MaxMemoryMB < 0 {
+		return dnsNameFile{}, errors.Errorf("invalid max memory %d", netConf.MaxMemoryMB)
+	}
+	masqConf.MaxMemoryMB = netConf.MaxMemoryMB
+	masqConf.ListenAddressesV4 = netConf.ListenAddressesV4
+	masqConf.ListenAddressesV6 = netConf.ListenAddressesV6
+	if netConf.PTRRecords && !netConf.MultiDomain {
+		return dnsNameFile{}, errors.Errorf("reverse records require multi domain mode")
+	}
+	masqConf.PTRRecords = netConf.PTRRecords
+	masqConf.LogFile = netConf.DNSMasqLogFile
+	masqConf.LogQueries = netConf.LogQueries
+	if masqConf.LogQueries && masqConf.LogFile == "" {
+		// queries of each network are logged separately
+		masqConf.LogFile = makePath(netConf.Name, queryLogFileName)
+	}
+	masqConf.ReloadDebounceMs = netConf.ReloadDebounceMs
+	if netConf.MaxLogSizeKB < 0 {
+		return dnsNameFile{}, errors.Errorf("invalid max log size %d", netConf.MaxLogSizeKB)
+	}
+	masqConf.MaxLogSizeKB = netConf.MaxLogSizeKB
+	if netConf.Subnet != "" {
+		if _, _, err := net.ParseCIDR(netConf.Subnet); err != nil {
+			return dnsNameFile{}, errors.Wrapf(err, "invalid subnet")
+		}
+	}
+	masqConf.Subnet = netConf.Subnet
+	if netConf.Reverse && netConf.Subnet == "" {
+		return dnsNameFile{}, errors.Errorf("reverse zones require the subnet")
+	}
+	masqConf.Reverse = netConf.Reverse
+	switch netConf.OutOfSubnet {
+	case "", outOfSubnetReject, outOfSubnetSkip:
+	default:
+		return dnsNameFile{}, errors.Errorf("invalid out of subnet policy %q", netConf.OutOfSubnet)
+	}
+	masqConf.OutOfSubnet = netConf.OutOfSubnet
+	masqConf.DisableIPv6Firewall = netConf.DisableIPv6Firewall
+	masqConf.DisableFirewall = netConf.DisableFirewall
+	if netConf.DNSPort < 0 || netConf.DNSPort > 65535 {
+		return dnsNameFile{}, errors.Errorf("invalid DNS port %d", netConf.DNSPort)
+	}
+	masqConf.DNSPort = netConf.DNSPort
+	masqConf.DetectConfigDrift = netConf.DetectConfigDrift
+	masqConf.Nameservers = netConf.Nameservers
+	masqConf.ResolvFile = netConf.ResolvFile
+	masqConf.Netns = netConf.Netns
+	if netConf.StartAttempts < 0 {
+		return dnsNameFile{}, errors.Errorf("invalid number of start attempts %d", netConf.StartAttempts)
+	}
+	masqConf.StartAttempts = netConf.StartAttempts
+	if netConf.StartRetryDelayMs < 0 {
+		return dnsNameFile{}, errors.Errorf("invalid start retry delay %d", netConf.StartRetryDelayMs)
+	}
+	masqConf.StartRetryDelayMs = netConf.StartRetryDelayMs
+	masqConf.BindMode = netConf.BindMode
+	masqConf.CacheSize = netConf.CacheSize
+	masqConf.NegTTL = netConf.NegTTL
+	masqConf.NoNegcache = netConf.NoNegcache
+	masqConf.ExtraOptions = netConf.ExtraOptions
+	if netConf.Ndots < 0 || netConf.Ndots > maxResolvConfNdots {
+		return dnsNameFile{}, errors.Errorf("invalid ndots %d", netConf.Ndots)
+	}
+	masqConf.Ndots = netConf.Ndots
+	if netConf.ResolvConf {
+		masqConf.ResolvConfFile = makePath(netConf.Name, resolvConfFileName)
+	}
+	if netConf.FileMode != "" {
+		mode, err := strconv.ParseUint(netConf.FileMode, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return dnsNameFile{}, errors.Errorf("invalid file mode %q", netConf.FileMode)
+		}
+		masqConf.FileMode = os.FileMode(mode)
+	}
+	switch netConf.FirewallBackend {
+	case "", firewallIPTables, firewallNFTables:
+		masqConf.FirewallBackend = netConf.FirewallBackend
+	default:
+		return dnsNameFile{}, errors.Errorf("invalid firewall backend %q", netConf.FirewallBackend)
+	}
+	masqConf.IPTablesPlacement = ipTablesPlacement{
+		Table:    netConf.IPTablesTable,
+		Chain:    netConf.IPTablesChain,
+		Position: netConf.IPTablesPosition,
+		Append:   netConf.IPTablesAppend,
+	}
+	if err := masqConf.IPTablesPlacement.validate(); err != nil {
+		return dnsNameFile{}, err
+	}
+	if netConf.HostsFileBackups < 0 {
+		return dnsNameFile{}, errors.Errorf("invalid number of hosts file backups %d", netConf.HostsFileBackups)
+	}
+	masqConf.HostsFileBackups = netConf.HostsFileBackups
+	masqConf.FilterAAAA = netConf.FilterAAAA
+	masqConf.FilterANY = netConf.FilterANY
+	masqConf.AddSubnet = netConf.AddSubnet
+	masqConf.DNSLoopDetect = netConf.DNSLoopDetect
+	masqConf.LocalService = netConf.LocalService
+	switch netConf.Forwarding {
+	case "", forwardingAllServers, forwardingStrictOrder, forwardingDefault:
+	default:
+		return dnsNameFile{}, errors.Errorf("invalid forwarding strategy %q", netConf.Forwarding)
+	}
+	masqConf.Forwarding = netConf.Forwarding
+	masqConf.ValidateHostsFile = netConf.ValidateHostsFile
+	masqConf.PrimaryIPOnly = netConf.PrimaryIPOnly
+	if netConf.PersistInterval < 0 {
+		return dnsNameFile{}, errors.Errorf("invalid persist interval %d", netConf.PersistInterval)
+	}
+	masqConf.PersistDir = netConf.PersistDir
+	masqConf.PersistInterval = netConf.PersistInterval
+	switch netConf.EntryFormat {
+	case "", entryFormatAddnHosts:
+	case entryFormatHostRecord:
+		if !netConf.MultiDomain {
+			return dnsNameFile{}, errors.Errorf("%s entry format requires multi domain mode", netConf.EntryFormat)
+		}
+	default:
+		return dnsNameFile{}, errors.Errorf("invalid entry format %q", netConf.EntryFormat)
+	}
+	masqConf.EntryFormat = netConf.EntryFormat
+	return masqConf, nil
+}
+
 // hup sends a sighup to a running dnsmasq to reload its hosts file. if
 // there is no instance of the dnsmasq, then it simply starts it.
 func (d dnsNameFile) hup() error {
-	// First check for pidfile; if it does not exist, we just
-	// start the service
-	isRunning, pid := d.isRunning()
-	if !isRunning {
-		return d.start()
+	// quiesced instance is started only on resume
+	if d.isQuiesced() {
+		return nil
+	}
+	// if the instance is not running, we just start the service
+	if err := reloadDNSMasq(d.PidFile); errors.Cause(err) != ErrDNSMasqNotRunning {
+		return err
+	}
+	return d.restartStale()
+}
+
+// restartStale starts a fresh dnsmasq instance in place of the dead one, e.g.
+// killed by the OOM killer. The stale pid file is removed first. It must be
+// called under the lock, so concurrent invocations don't start two instances.
+func (d dnsNameFile) restartStale() error {
+	if err := os.Remove(d.PidFile); err == nil {
+		logrus.Warnf("dnsmasq instance of %s is dead, restarting it", d.PidFile)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return d.start()
+}
+
+// restart stops the running dnsmasq instance and starts it again. It is required
+// when the configuration files change as dnsmasq reads them only on start.
+func (d dnsNameFile) restart() error {
+	if d.isQuiesced() {
+		return nil
+	}
+	if isRunning, _ := d.isRunning(); isRunning {
+		if err := d.stop(); err != nil {
+			return err
+		}
+	}
+	return d.start()
+}
+
+// reload applies changes to the dnsmasq instance: hosts file changes are applied
+// with sighup, configuration changes require restart.
+func (d dnsNameFile) reload(confChanged bool) error {
+	if err := d.rotateLog(); err != nil {
+		logrus.Errorf("unable to rotate %q: %v", d.LogFile, err)
+	}
+	if confChanged {
+		// the restarted instance reads the hosts files anyway
+		if err := os.Remove(d.hupStampFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return d.restart()
+	}
+	// the dead instance is restarted at once
+	if isRunning, _ := d.isRunning(); isRunning && d.reloadDebounce() > 0 {
+		request, err := d.requestHUP()
+		if err != nil {
+			return err
+		}
+		pendingHUPs[d.PidFile] = request
+		return nil
+	}
+	return d.hup()
+}
+
+// hupRequest is the sighup of the dnsmasq instance requested by the invocation
+type hupRequest struct {
+	conf  dnsNameFile
+	token string
+}
+
+// reloadDebounce returns the window the sighups are coalesced in, zero if the
+// sighups are sent at once
+func (d dnsNameFile) reloadDebounce() time.Duration {
+	switch {
+	case d.ReloadDebounceMs < 0:
+		return 0
+	case d.ReloadDebounceMs == 0:
+		return defaultReloadDebounce
+	}
+	return time.Duration(d.ReloadDebounceMs) * time.Millisecond
+}
+
+// hupStampFile returns the path of the file recording the latest sighup request
+func (d dnsNameFile) hupStampFile() string {
+	return filepath.Join(filepath.Dir(d.PidFile), hupStampFileName)
+}
+
+// requestHUP records the sighup request in the stamp file of the network
+// replacing the requests of the other invocations, so only the latest request of
+// a burst sends the sighup. The time of the oldest pending request is kept. It
+// must be called under the lock.
+func (d dnsNameFile) requestHUP() (hupRequest, error) {
+	now := time.Now()
+	token := fmt.Sprintf("%d-%d", os.Getpid(), now.UnixNano())
+	since := now
+	if _, pendingSince, err := d.readHUPStamp(); err == nil {
+		since = pendingSince
+	}
+	content := fmt.Sprintf("%s %d\n", token, since.UnixNano())
+	if err := writeFileAtomic(d.hupStampFile(), []byte(content), d.fileMode()); err != nil {
+		return hupRequest{}, err
 	}
-	return pid.Signal(unix.SIGHUP)
+	return hupRequest{conf: d, token: token}, nil
+}
+
+// readHUPStamp returns the token of the latest sighup request and the time of
+// the oldest pending one
+func (d dnsNameFile) readHUPStamp() (string, time.Time, error) {
+	content, err := ioutil.ReadFile(d.hupStampFile())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var (
+		token string
+		since int64
+	)
+	if _, err := fmt.Sscanf(string(content), "%s %d", &token, &since); err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "invalid sighup stamp %q", d.hupStampFile())
+	}
+	return token, time.Unix(0, since), nil
+}
+
+// serve sends the requested sighup unless a newer request is pending, which
+// sends it instead, or the pending requests are served already. The sighup is
+// sent anyway if the requests have been pending for too long. It must be called
+// under the lock.
+func (r hupRequest) serve() error {
+	token, since, err := r.conf.readHUPStamp()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		logrus.Warnf("%v, sending sighup", err)
+	} else if token != r.token && time.Since(since) < reloadMaxDelayFactor*r.conf.reloadDebounce() {
+		return nil
+	}
+	if err := os.Remove(r.conf.hupStampFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.conf.hup()
+}
+
+// flush waits for the debounce window and serves the request. It must be called
+// without the lock, so the concurrent invocations can record their requests.
+func (r hupRequest) flush(lockTimeout time.Duration) error {
+	time.Sleep(r.conf.reloadDebounce())
+	lock, err := getLock(dnsNameConfPath())
+	if err != nil {
+		return err
+	}
+	if err := lock.acquireWithTimeout(lockTimeout); err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.release(); err != nil {
+			logrus.Errorf("unable to release lock for %q: %v", dnsNameConfPath(), err)
+		}
+	}()
+	return r.serve()
+}
+
+// flushHUPs serves the sighups requested by the invocation
+func flushHUPs(lockTimeout time.Duration) {
+	for pidFile, request := range pendingHUPs {
+		delete(pendingHUPs, pidFile)
+		if err := request.flush(lockTimeout); err != nil {
+			logrus.Errorf("unable to reload dnsmasq instance of %s: %v", pidFile, err)
+		}
+	}
+}
+
+// rotateLog rotates the dnsmasq log file exceeding the max log size as dnsmasq
+// doesn't rotate it. The previous log is kept with the .1 suffix.
+func (d dnsNameFile) rotateLog() error {
+	if d.LogFile == "" || d.MaxLogSizeKB == 0 {
+		return nil
+	}
+	info, err := os.Stat(d.LogFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Size() <= int64(d.MaxLogSizeKB)<<10 {
+		return nil
+	}
+	if err := os.Rename(d.LogFile, d.LogFile+".1"); err != nil {
+		return err
+	}
+	// dnsmasq reopens the log file on SIGUSR2
+	if isRunning, pid := d.isRunning(); isRunning {
+		return pid.Signal(unix.SIGUSR2)
+	}
+	return nil
+}
+
+// quiesce stops the dnsmasq instance keeping the network files and iptables
+// rules, the instance is not started until resume
+func (d dnsNameFile) quiesce() error {
+	if err := ioutil.WriteFile(d.quiescedFile(), nil, d.fileMode()); err != nil {
+		return err
+	}
+	return d.stop()
+}
+
+// resume starts the quiesced dnsmasq instance
+func (d dnsNameFile) resume() error {
+	if err := os.Remove(d.quiescedFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if isRunning, _ := d.isRunning(); isRunning {
+		return nil
+	}
+	return d.start()
+}
+
+// isQuiesced determines if the dnsmasq instance is quiesced
+func (d dnsNameFile) isQuiesced() bool {
+	_, err := os.Stat(d.quiescedFile())
+	return err == nil
+}
+
+// quiescedFile returns the path of the quiesced instance marker
+func (d dnsNameFile) quiescedFile() string {
+	return filepath.Join(filepath.Dir(d.PidFile), quiescedFileName)
 }
 
 // determines if selected dnsmasq instance is running
@@ -64,39 +469,209 @@ func (d dnsNameFile) isRunning() (bool, *os.Process) {
 	return true, pid
 }
 
-// start starts the dnsmasq instance.
+// processAlive checks whether the process with the given PID exists
+func processAlive(pid int) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	return err == nil
+}
+
+// start starts the dnsmasq instance. Transient failures are retried with an
+// exponential backoff, the instance is started only if it wrote the pid file.
 func (d dnsNameFile) start() error {
+	attempts := d.StartAttempts
+	if attempts == 0 {
+		attempts = defaultStartAttempts
+	}
+	delay := time.Duration(d.StartRetryDelayMs) * time.Millisecond
+	if delay == 0 {
+		delay = defaultStartRetryDelay
+	}
+	for attempt := 1; ; attempt++ {
+		_, err := startDNSMasq(d)
+		if err == nil {
+			return nil
+		}
+		// the configuration error doesn't go away on retry
+		var exitErr *exec.ExitError
+		if attempt >= attempts || errors.As(err, &exitErr) && exitErr.ExitCode() == dnsMasqConfigErrorCode {
+			return err
+		}
+		logrus.Warnf("dnsmasq start attempt %d failed, retrying in %s: %v", attempt, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxStartRetryDelay {
+			delay = maxStartRetryDelay
+		}
+	}
+}
+
+// dnsMasqArgs returns the arguments dnsmasq is started with
+func dnsMasqArgs(d dnsNameFile) []string {
 	args := []string{
 		"-u",
 		"root",
 		fmt.Sprintf("--conf-file=%s", d.ConfigFile),
 	}
-	output, err := exec.Command(d.Binary, args...).CombinedOutput()
+	if d.PidFile != "" {
+		args = append(args, fmt.Sprintf("--pid-file=%s", d.PidFile))
+	}
+	return args
+}
+
+// dnsMasqCommand returns the command starting dnsmasq. With the memory limit
+// dnsmasq is started through the plugin binary, which sets the limit and
+// execs dnsmasq. The limit is inherited across exec, so it covers the startup
+// allocations, e.g. of the cache, unlike a limit applied to the daemon.
+func dnsMasqCommand(d dnsNameFile) (*exec.Cmd, error) {
+	if d.MaxMemoryMB == 0 {
+		return exec.Command(d.Binary, dnsMasqArgs(d)...), nil
+	}
+	self, err := os.Executable()
 	if err != nil {
-		return errors.Errorf("Message: %s, err: %v", string(output), err)
+		return nil, errors.Wrap(err, "unable to find the plugin binary to limit dnsmasq memory")
 	}
+	args := append([]string{execLimitedCommand, strconv.Itoa(d.MaxMemoryMB), d.Binary}, dnsMasqArgs(d)...)
+	return exec.Command(self, args...), nil
+}
 
-	return nil
+// execLimited caps the address space of the process and replaces it with the
+// binary, the arguments are the limit in MB, the binary path and its arguments
+func execLimited(args []string) error {
+	maxMemoryMB, err := strconv.Atoi(args[0])
+	if err != nil || maxMemoryMB <= 0 {
+		return errors.Errorf("invalid max memory %q", args[0])
+	}
+	limit := uint64(maxMemoryMB) << 20
+	if err := unix.Setrlimit(unix.RLIMIT_AS, &unix.Rlimit{Cur: limit, Max: limit}); err != nil {
+		return errors.Wrap(err, "unable to limit memory")
+	}
+	return unix.Exec(args[1], args[1:], os.Environ())
+}
+
+// startDNSMasq runs the dnsmasq binary, without a shell, and waits until the
+// daemon writes the pid file of the live process. It is replaced in tests.
+var startDNSMasq = func(d dnsNameFile) (*exec.Cmd, error) {
+	// dnsmasq reports configuration errors to stderr and exits before daemonizing
+	var stderr bytes.Buffer
+	cmd, err := dnsMasqCommand(d)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = &stderr
+	// the process started in the namespace keeps it after daemonizing
+	if err := d.inNetNS(cmd.Run); err != nil {
+		output := strings.TrimSpace(stderr.String())
+		if strings.Contains(output, "Address in use") || strings.Contains(output, "Address already in use") {
+			var owner string
+			_ = d.inNetNS(func() error {
+				owner = describePortOwner(d.port())
+				return nil
+			})
+			return nil, errors.Wrapf(ErrDNSPortInUse, "dnsmasq failed to start, port %d is bound%s: %s", d.port(), owner, output)
+		}
+		return nil, errors.Wrapf(err, "dnsmasq failed to start: %s", output)
+	}
+	if _, err := d.waitForProcess(); err != nil {
+		return nil, errors.Wrapf(err, "dnsmasq didn't write the pid file")
+	}
+	return cmd, nil
+}
+
+// defaultStartAttempts is the number of the dnsmasq start attempts
+const defaultStartAttempts = 3
+
+// dnsMasqConfigErrorCode is the exit code of dnsmasq on a configuration error
+const dnsMasqConfigErrorCode = 1
+
+// withNetNS runs fn in the network namespace at the path, it is replaced in tests
+var withNetNS = func(path string, fn func() error) error {
+	return ns.WithNetNSPath(path, func(ns.NetNS) error {
+		return fn()
+	})
+}
+
+// inNetNS runs fn in the network namespace of the dnsmasq instance, in the
+// current one if no namespace is configured
+func (d dnsNameFile) inNetNS(fn func() error) error {
+	if d.Netns == "" {
+		return fn()
+	}
+	return withNetNS(d.netnsPath(), fn)
+}
+
+// netnsPath returns the path of the network namespace, a bare name refers to
+// the namespace created by ip netns
+func (d dnsNameFile) netnsPath() string {
+	if strings.Contains(d.Netns, "/") {
+		return d.Netns
+	}
+	return filepath.Join(netnsDir, d.Netns)
 }
 
 // stop stops the dnsmasq instance.
 func (d dnsNameFile) stop() error {
-	pid, err := d.getProcess()
+	return stopDNSMasq(d)
+}
+
+// stopDNSMasq stops the dnsmasq instance gracefully: it is terminated and
+// killed only if it doesn't exit within stopGracePeriod. The pid file is
+// removed, so it is safe to call with a stale pid file of a dead instance. The
+// process the pid file points to is not signaled if it is not the instance of
+// the network, e.g. the pid has been reused, the instance is considered stopped.
+func stopDNSMasq(conf dnsNameFile) error {
+	pid, err := conf.getProcess()
 	if os.IsNotExist(err) {
 		return nil
 	}
 	if err != nil {
-		return err
+		logrus.Warnf("removing malformed pid file %s: %v", conf.PidFile, err)
+		return os.Remove(conf.PidFile)
 	}
-	if err = pid.Kill(); err != nil {
-		if strings.Contains(err.Error(), "process already finished") {
-			return nil
+	// the command line of the exited process can't be read, it is handled below
+	if owned, err := conf.ownsProcess(pid); err == nil && !owned {
+		logrus.Warnf("pid file %s points to process %d not managed by the plugin, removing it", conf.PidFile, pid.Pid)
+		if err := os.Remove(conf.PidFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := pid.Signal(unix.SIGTERM); err == nil {
+		deadline := time.Now().Add(stopGracePeriod)
+		for processAlive(pid.Pid) && time.Now().Before(deadline) {
+			time.Sleep(pidFilePollInterval)
+		}
+		if processAlive(pid.Pid) {
+			logrus.Warnf("dnsmasq %d didn't exit on SIGTERM, killing it", pid.Pid)
+			if err := pid.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				return err
+			}
 		}
+	} else if !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	if err := os.Remove(conf.PidFile); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
 }
 
+// waitForProcess waits for the pid file written by the dnsmasq daemon shortly
+// after spawn and returns the process. The pid file may be missing or still
+// empty right after spawn, so reading is retried until pidFileTimeout. The
+// process of the pid file must be alive.
+func (d dnsNameFile) waitForProcess() (*os.Process, error) {
+	deadline := time.Now().Add(pidFileTimeout)
+	for {
+		pid, err := d.getProcess()
+		if err == nil && !processAlive(pid.Pid) {
+			err = errors.Wrapf(ErrDNSMasqNotRunning, "process %d of %s", pid.Pid, d.PidFile)
+		}
+		if err == nil || time.Now().After(deadline) {
+			return pid, err
+		}
+		time.Sleep(pidFilePollInterval)
+	}
+}
+
 // getProcess reads the PID for the dnsmasq instance and returns an
 // *os.Process. Returns an error if the PID does not exist.
 func (d dnsNameFile) getProcess() (*os.Process, error) {
@@ -111,6 +686,423 @@ func (d dnsNameFile) getProcess() (*os.Process, error) {
 	return os.FindProcess(pid)
 }
 
+// checkForeignDNSMasq detects a DNS server not managed by the plugin which has
+// the DNS port bound on the interface addresses while the plugin instance is
+// not running. The stale pid file pointing to another process is removed, so
+// the process is not signaled or stopped as the plugin instance.
+func (d dnsNameFile) checkForeignDNSMasq(addresses []string) error {
+	if pid, err := d.getProcess(); err == nil && pid.Signal(syscall.Signal(0)) == nil {
+		owned, err := d.ownsProcess(pid)
+		if err != nil {
+			return err
+		}
+		if owned {
+			return nil
+		}
+		logrus.Warnf("pid file %s points to process %d not managed by the plugin, removing it", d.PidFile, pid.Pid)
+		if err := os.Remove(d.PidFile); err != nil {
+			return err
+		}
+	}
+	return d.inNetNS(func() error {
+		for _, address := range addresses {
+			if err := checkDNSPort(address, d.port()); err != nil {
+				if errors.Cause(err) == ErrDNSPortInUse {
+					return errors.Wrap(ErrForeignDNSMasq, err.Error())
+				}
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkDNSPort binds the DNS port on the address the same way as dnsmasq binds
+// it and reports the process holding the port if it is already bound. It must
+// be called in the network namespace of the dnsmasq instance.
+func checkDNSPort(address string, port int) error {
+	listenConfig := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		if errors.Is(err, unix.EADDRINUSE) {
+			return errors.Wrapf(ErrDNSPortInUse, "port %d of %s is bound%s", port, address, describePortOwner(port))
+		}
+		return err
+	}
+	return conn.Close()
+}
+
+// describePortOwner names the process holding the UDP port in the current
+// network namespace, empty if it can't be found, e.g. without the privileges to
+// inspect other processes
+func describePortOwner(port int) string {
+	inodes := map[string]bool{}
+	for _, table := range []string{"/proc/thread-self/net/udp", "/proc/thread-self/net/udp6"} {
+		content, err := ioutil.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n")[1:] {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(line)
+			if len(fields) < 10 {
+				continue
+			}
+			hexPort := fields[1][strings.LastIndex(fields[1], ":")+1:]
+			if localPort, err := strconv.ParseUint(hexPort, 16, 16); err == nil && int(localPort) == port {
+				inodes[fields[9]] = true
+			}
+		}
+	}
+	if len(inodes) == 0 {
+		return ""
+	}
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		target, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(target, "socket:[") {
+			continue
+		}
+		if !inodes[strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")] {
+			continue
+		}
+		pidDir := filepath.Dir(filepath.Dir(fd))
+		comm, _ := ioutil.ReadFile(filepath.Join(pidDir, "comm"))
+		return fmt.Sprintf(" by process %s (%s)", filepath.Base(pidDir), strings.TrimSpace(string(comm)))
+	}
+	return ""
+}
+
+// probeDNSMasq checks that the dnsmasq instance answers DNS queries: the SOA
+// query of the network domain is sent to the instance addresses and a valid
+// answer of any of them within dnsProbeTimeout is required.
+func probeDNSMasq(conf dnsNameFile) error {
+	addresses, err := getInterfaceAddresses(conf)
+	if err != nil {
+		return err
+	}
+	addresses = append(addresses, conf.ListenAddressesV4...)
+	addresses = append(addresses, conf.ListenAddressesV6...)
+	if len(addresses) == 0 {
+		return ErrNoIPAddressFound
+	}
+	domain, err := asciiDomain(conf.Domain)
+	if err != nil {
+		return err
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(domain, ".") + ".")
+	if err != nil {
+		return errors.Wrapf(err, "invalid domain %q", conf.Domain)
+	}
+	id := uint16(rand.Uint32())
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := builder.StartQuestions(); err != nil {
+		return err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}); err != nil {
+		return err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return err
+	}
+	err = conf.inNetNS(func() error {
+		var err error
+		for _, address := range addresses {
+			if err = queryDNS(net.JoinHostPort(address, strconv.Itoa(conf.port())), query, id); err == nil {
+				return nil
+			}
+			logrus.Debugf("dnsmasq probe of %s failed: %v", address, err)
+		}
+		return err
+	})
+	return errors.Wrapf(err, "dnsmasq instance doesn't answer DNS queries")
+}
+
+// queryDNS sends the query to the DNS server at address and waits for the
+// answer with the query id. The answers of the local domain may be negative.
+func queryDNS(address string, query []byte, id uint16) error {
+	conn, err := net.DialTimeout("udp", address, dnsProbeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(dnsProbeTimeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return err
+	}
+	answer := make([]byte, 4096)
+	for {
+		n, err := conn.Read(answer)
+		if err != nil {
+			return err
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(answer[:n])
+		// stray and malformed datagrams are skipped until the deadline
+		if err != nil || !header.Response || header.ID != id {
+			continue
+		}
+		if header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+			return errors.Errorf("DNS query failed: %s", header.RCode)
+		}
+		return nil
+	}
+}
+
+// LocalDomains returns the domains served by the dnsmasq instance, the primary
+// domain first. It is exported to be used in the dnsmasq template.
+func (d dnsNameFile) LocalDomains() []string {
+	domains := []string{d.Domain}
+	for _, domain := range d.Domains {
+		if hostNameKey(domain) != hostNameKey(d.Domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// ReverseZones returns the reverse zones of the network subnet answered
+// locally with the reverse option, so the reverse lookups of the pod addresses
+// are served from the hosts file and are not forwarded. It is exported to be
+// used in the dnsmasq template.
+func (d dnsNameFile) ReverseZones() ([]string, error) {
+	if !d.Reverse {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(d.Subnet)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reverse zones require a valid subnet")
+	}
+	return reverseZones(subnet), nil
+}
+
+// reverseZones returns the in-addr.arpa or ip6.arpa zones covering the subnet.
+// The zones are delegated on the octet (IPv4) or nibble (IPv6) boundaries, so
+// the subnet not aligned to the boundary is covered by several zones.
+func reverseZones(subnet *net.IPNet) []string {
+	ones, _ := subnet.Mask.Size()
+	var (
+		labels []byte
+		bits   int
+		suffix string
+	)
+	if ip := subnet.IP.To4(); ip != nil {
+		labels, bits, suffix = append([]byte{}, ip...), 8, "in-addr.arpa"
+	} else {
+		for _, b := range subnet.IP.To16() {
+			labels = append(labels, b>>4, b&0xf)
+		}
+		bits, suffix = 4, "ip6.arpa"
+	}
+	count := (ones + bits - 1) / bits
+	zones := make([]string, 0, 1<<(count*bits-ones))
+	for i := 0; i < 1<<(count*bits-ones); i++ {
+		parts := []string{suffix}
+		for j := 0; j < count; j++ {
+			label := labels[j]
+			if j == count-1 {
+				label |= byte(i)
+			}
+			if bits == 8 {
+				parts = append([]string{strconv.Itoa(int(label))}, parts...)
+			} else {
+				parts = append([]string{strconv.FormatInt(int64(label), 16)}, parts...)
+			}
+		}
+		zones = append(zones, strings.Join(parts, "."))
+	}
+	return zones
+}
+
+// ownsProcess checks whether the process is the dnsmasq instance started with
+// the configuration file of the network
+func (d dnsNameFile) ownsProcess(pid *os.Process) (bool, error) {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid.Pid))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Contains(cmdline, []byte(fmt.Sprintf("--conf-file=%s", d.ConfigFile))), nil
+}
+
+const (
+	// instanceAlive means that the pid file points to the dnsmasq instance of the network
+	instanceAlive = "alive"
+	// instanceDead means that the pid file is stale, the process has exited or is not the instance of the network
+	instanceDead = "dead"
+	// instanceMissing means that the network has no pid file
+	instanceMissing = "missing"
+	// instanceUnknown means that the pid file can't be read, the error is reported
+	instanceUnknown = "unknown"
+)
+
+// instanceStatus is the status of the dnsmasq instance of the network
+type instanceStatus struct {
+	Network   string `json:"network"`
+	Interface string `json:"interface,omitempty"`
+	PID       int    `json:"pid,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// listInstances reports the status of the dnsmasq instances of all networks
+// from their pid files. The failures are reported per network, so a single
+// unreadable network doesn't fail the whole walk. It doesn't require the lock,
+// the status may be outdated by the time it is returned.
+func listInstances() ([]instanceStatus, error) {
+	items, err := ioutil.ReadDir(dnsNameConfPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	statuses := make([]instanceStatus, 0, len(items))
+	for _, item := range items {
+		if !item.IsDir() {
+			continue
+		}
+		statuses = append(statuses, getInstanceStatus(item.Name()))
+	}
+	return statuses, nil
+}
+
+// getInstanceStatus reports the status of the dnsmasq instance of the network
+func getInstanceStatus(networkName string) instanceStatus {
+	status := instanceStatus{Network: networkName, Status: instanceUnknown}
+	if data, err := ioutil.ReadFile(makePath(networkName, interfaceFileName)); err == nil {
+		status.Interface = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		status.Error = err.Error()
+		return status
+	}
+	conf := dnsNameFile{
+		ConfigFile: makePath(networkName, confFileName),
+		PidFile:    makePath(networkName, pidFileName),
+	}
+	pid, err := conf.getProcess()
+	if os.IsNotExist(err) {
+		status.Status = instanceMissing
+		return status
+	}
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.PID = pid.Pid
+	status.Status = instanceDead
+	if processAlive(pid.Pid) {
+		if owned, err := conf.ownsProcess(pid); err == nil && owned {
+			status.Status = instanceAlive
+		}
+	}
+	return status
+}
+
+// terminate sends SIGTERM to the running dnsmasq instance. The process the pid
+// file points to is not signaled if it is not the instance of the network.
+func (d dnsNameFile) terminate() error {
+	isRunning, pid := d.isRunning()
+	if !isRunning {
+		return nil
+	}
+	owned, err := d.ownsProcess(pid)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		logrus.Warnf("pid file %s points to process %d not managed by the plugin, not terminating it", d.PidFile, pid.Pid)
+		return nil
+	}
+	return pid.Signal(unix.SIGTERM)
+}
+
+// port returns the DNS port of the dnsmasq instance
+func (d dnsNameFile) port() int {
+	if d.DNSPort == 0 {
+		return defaultDNSPort
+	}
+	return d.DNSPort
+}
+
+// serverAddresses returns the addresses of the instance in the dnsmasq server
+// format, the non-default port is appended to the address
+func (d dnsNameFile) serverAddresses(addresses []string) []string {
+	if d.port() == defaultDNSPort {
+		return addresses
+	}
+	servers := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		servers = append(servers, fmt.Sprintf("%s#%d", address, d.port()))
+	}
+	return servers
+}
+
+// claimInterface records the network interface of the dnsmasq instance. It
+// fails if the interface is already claimed by another network as both
+// networks would fight over the same dnsmasq listener and iptables rule. The
+// network directory is created only once the interface is claimed, so the
+// failed claim leaves nothing behind.
+func claimInterface(conf dnsNameFile) error {
+	curDir := filepath.Base(filepath.Dir(conf.InterfaceFile))
+	items, err := ioutil.ReadDir(dnsNameConfPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, item := range items {
+		if !item.IsDir() || item.Name() == curDir {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dnsNameConfPath(), item.Name(), interfaceFileName))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if strings.TrimSpace(string(data)) == conf.NetworkInterface {
+			return errors.Wrapf(ErrInterfaceInUse, "interface %s is claimed by network %s", conf.NetworkInterface, item.Name())
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.InterfaceFile), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(conf.InterfaceFile, []byte(conf.NetworkInterface+"\n"), conf.fileMode())
+}
+
+// save stores the dnsmasq instance options in the network directory, so the
+// instance can be managed without the network configuration
+func (d dnsNameFile) save() error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(filepath.Dir(d.PidFile), optionsFileName), data, d.fileMode())
+}
+
+// loadDNSMasqFile loads the dnsmasq instance options stored in the network directory
+func loadDNSMasqFile(networkName string) (dnsNameFile, error) {
+	data, err := ioutil.ReadFile(makePath(networkName, optionsFileName))
+	if err != nil {
+		return dnsNameFile{}, err
+	}
+	var conf dnsNameFile
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return dnsNameFile{}, errors.Wrapf(err, "invalid options of network %s", networkName)
+	}
+	return conf, nil
+}
+
 // makePath formats a path name given a domain and suffix
 func makePath(networkName, fileName string) string {
 	// the generic path for where conf, host, pid files are kept is:
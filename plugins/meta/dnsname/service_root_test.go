@@ -0,0 +1,51 @@
+//go:build root
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestStartDNSMasqMemoryLimit(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the test must be run as root")
+	}
+	binary, err := exec.LookPath("dnsmasq")
+	if err != nil {
+		t.Skip("dnsmasq is not available")
+	}
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		Binary:      binary,
+		ConfigFile:  filepath.Join(tmpDir, confFileName),
+		PidFile:     filepath.Join(tmpDir, pidFileName),
+		MaxMemoryMB: 64,
+	}
+	// the DNS service is disabled, so the instance doesn't bind the port
+	if err := ioutil.WriteFile(conf.ConfigFile, []byte("port=0\n"), defaultFileMode); err != nil {
+		t.Fatalf("Can't write config: %v", err)
+	}
+	if _, err := startDNSMasq(conf); err != nil {
+		t.Fatalf("Can't start dnsmasq: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := conf.stop(); err != nil {
+			t.Errorf("Can't stop dnsmasq: %v", err)
+		}
+	})
+	pid, err := conf.getProcess()
+	if err != nil {
+		t.Fatalf("Can't get dnsmasq process: %v", err)
+	}
+	if soft, hard := addressSpaceLimit(t, pid.Pid); soft != "67108864" || hard != "67108864" {
+		t.Errorf("Wrong address space limit of dnsmasq: %s %s", soft, hard)
+	}
+}
@@ -0,0 +1,872 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestClaimInterface(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	for _, networkName := range []string{"net1", "net2"} {
+		if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), networkName), 0700); err != nil {
+			t.Fatalf("Can't create network dir: %v", err)
+		}
+	}
+	net1 := dnsNameFile{NetworkInterface: "cni0", InterfaceFile: makePath("net1", interfaceFileName)}
+	if err := claimInterface(net1); err != nil {
+		t.Fatalf("Can't claim interface: %v", err)
+	}
+	// claiming the interface again by the same network is allowed
+	if err := claimInterface(net1); err != nil {
+		t.Fatalf("Can't claim interface again: %v", err)
+	}
+	net2 := dnsNameFile{NetworkInterface: "cni0", InterfaceFile: makePath("net2", interfaceFileName)}
+	if err := claimInterface(net2); errors.Cause(err) != ErrInterfaceInUse {
+		t.Fatalf("Expected interface in use error, got: %v", err)
+	}
+	if _, err := os.Stat(net2.InterfaceFile); !os.IsNotExist(err) {
+		t.Errorf("Interface file should not be created for colliding network")
+	}
+	net2.NetworkInterface = "cni1"
+	if err := claimInterface(net2); err != nil {
+		t.Fatalf("Can't claim interface: %v", err)
+	}
+	data, err := ioutil.ReadFile(net2.InterfaceFile)
+	if err != nil {
+		t.Fatalf("Can't read file: %v", err)
+	}
+	if string(data) != "cni1\n" {
+		t.Errorf("Wrong interface file content: %s", string(data))
+	}
+	// the directory of the network failing to claim the interface is not created
+	net3 := dnsNameFile{
+		NetworkInterface: "cni0",
+		InterfaceFile:    makePath("net3", interfaceFileName),
+		PidFile:          makePath("net3", pidFileName),
+	}
+	if err := setupNetwork(net3); errors.Cause(err) != ErrInterfaceInUse {
+		t.Fatalf("Expected interface in use error, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(net3.InterfaceFile)); !os.IsNotExist(err) {
+		t.Errorf("Network directory should not be left behind: %v", err)
+	}
+}
+
+func init() {
+	// the test binary stands in for the plugin binary starting dnsmasq under
+	// the memory limit
+	if len(os.Args) > 1 && os.Args[1] == execLimitedCommand {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "dnsname: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// addressSpaceLimit returns the soft and hard address space limits of the process
+func addressSpaceLimit(t *testing.T, pid int) (string, string) {
+	limits, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/limits", pid))
+	if err != nil {
+		t.Fatalf("Can't read limits: %v", err)
+	}
+	for _, line := range strings.Split(string(limits), "\n") {
+		if strings.HasPrefix(line, "Max address space") {
+			if fields := strings.Fields(line); len(fields) >= 5 {
+				return fields[3], fields[4]
+			}
+		}
+	}
+	t.Fatal("Address space limit not found")
+	return "", ""
+}
+
+func TestLimitMemory(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not available")
+	}
+	conf := dnsNameFile{Binary: sleep, ConfigFile: "dnsmasq.conf", MaxMemoryMB: 64}
+	cmd, err := dnsMasqCommand(conf)
+	if err != nil {
+		t.Fatalf("Can't create command: %v", err)
+	}
+	expected := append([]string{execLimitedCommand, "64", sleep}, dnsMasqArgs(conf)...)
+	if !reflect.DeepEqual(cmd.Args[1:], expected) {
+		t.Errorf("Expected args %v got %v", expected, cmd.Args[1:])
+	}
+	// sleep doesn't take the dnsmasq options
+	cmd.Args = append(cmd.Args[:4], "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Can't start process: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	// the limit is set before exec, so it is in place once the binary runs
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		cmdline, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", cmd.Process.Pid))
+		if strings.HasPrefix(string(cmdline), sleep+"\x0010") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Process didn't exec")
+		}
+	}
+	if soft, hard := addressSpaceLimit(t, cmd.Process.Pid); soft != "67108864" || hard != "67108864" {
+		t.Errorf("Wrong address space limit: %s %s", soft, hard)
+	}
+	conf.MaxMemoryMB = 0
+	if direct, err := dnsMasqCommand(conf); err != nil || direct.Path != sleep {
+		t.Errorf("Binary should be run directly without the memory limit: %v", err)
+	}
+}
+
+// fakeDNSMasqInstances is the number of the live instances the fake dnsmasq
+// can pick from
+const fakeDNSMasqInstances = 3
+
+// fakeDNSMasq writes the fake dnsmasq binary running the script and writing
+// the pid of one of the sleeping processes owned by the test to the pid file.
+// The process stopped by the plugin is replaced, so every start gets a live
+// process which is reaped and doesn't linger as a zombie. The processes have
+// the command line of the instance with the config file next to the pid file.
+func fakeDNSMasq(t *testing.T, pidFile, script string) string {
+	dir := t.TempDir()
+	pool := filepath.Join(dir, "pids")
+	if err := os.Mkdir(pool, 0700); err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	configFile := filepath.Join(filepath.Dir(pidFile), confFileName)
+	done := make(chan struct{})
+	var wg, ready sync.WaitGroup
+	for i := 0; i < fakeDNSMasqInstances; i++ {
+		wg.Add(1)
+		ready.Add(1)
+		go func() {
+			defer wg.Done()
+			for first := true; ; first = false {
+				// the loop keeps the shell from exec'ing and losing the command line
+				cmd := exec.Command("sh", "-c", "while :; do sleep 1; done", "dnsmasq", "--conf-file="+configFile)
+				if err := cmd.Start(); err != nil {
+					if first {
+						ready.Done()
+					}
+					return
+				}
+				exited := make(chan struct{})
+				go func() {
+					_ = cmd.Wait()
+					close(exited)
+				}()
+				_ = ioutil.WriteFile(filepath.Join(pool, strconv.Itoa(cmd.Process.Pid)), nil, 0644)
+				if first {
+					ready.Done()
+				}
+				select {
+				case <-exited:
+				case <-done:
+					_ = cmd.Process.Kill()
+					<-exited
+					return
+				}
+			}
+		}()
+	}
+	t.Cleanup(func() {
+		close(done)
+		wg.Wait()
+	})
+	ready.Wait()
+	binary := filepath.Join(dir, "dnsmasq")
+	script = fmt.Sprintf("#!/bin/sh\n%[1]spid=$(ls %[2]s | head -n 1)\nrm %[2]s/$pid\necho $pid > %[3]s\n", script, pool, pidFile)
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatalf("Can't write binary: %v", err)
+	}
+	return binary
+}
+
+// fakeDNSResponder listens on a local UDP port and answers the queries with
+// the canned reply echoing the query while answer is set, returns the port
+func fakeDNSResponder(t *testing.T, answer *int32) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(answer) == 0 || n < 12 {
+				continue
+			}
+			// the query with the QR bit set is the empty answer
+			buf[2] |= 0x80
+			_, _ = conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestProbeDNSMasq(t *testing.T) {
+	timeout := dnsProbeTimeout
+	t.Cleanup(func() { dnsProbeTimeout = timeout })
+	dnsProbeTimeout = 100 * time.Millisecond
+	answer := int32(1)
+	conf := dnsNameFile{
+		Domain:            "test.org",
+		NetworkInterface:  "lo",
+		ListenAddressesV4: []string{"127.0.0.1"},
+		DNSPort:           fakeDNSResponder(t, &answer),
+	}
+	if err := probeDNSMasq(conf); err != nil {
+		t.Errorf("Probe should succeed: %v", err)
+	}
+	atomic.StoreInt32(&answer, 0)
+	start := time.Now()
+	err := probeDNSMasq(conf)
+	if err == nil {
+		t.Fatal("Probe should fail")
+	}
+	if netErr, ok := errors.Cause(err).(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Probe should time out, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Probe took too long: %s", elapsed)
+	}
+	conf.ListenAddressesV4 = nil
+	if err := probeDNSMasq(conf); errors.Cause(err) != ErrNoIPAddressFound {
+		t.Errorf("Probe without addresses should fail, got: %v", err)
+	}
+}
+
+func TestStartReportsConfigError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	binary := filepath.Join(tmpDir, "dnsmasq")
+	script := `#!/bin/sh
+echo "dnsmasq: bad option at line 16 of $3" >&2
+exit 1
+`
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatalf("Can't write binary: %v", err)
+	}
+	conf := dnsNameFile{Binary: binary, ConfigFile: filepath.Join(tmpDir, confFileName)}
+	err = conf.start()
+	if err == nil {
+		t.Fatal("Start should fail")
+	}
+	if !strings.Contains(err.Error(), "bad option at line 16 of --conf-file="+conf.ConfigFile) {
+		t.Errorf("Error should contain dnsmasq output, got: %v", err)
+	}
+}
+
+func TestStartDNSMasq(t *testing.T) {
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	conf := dnsNameFile{
+		ConfigFile: filepath.Join(tmpDir, confFileName),
+		PidFile:    filepath.Join(tmpDir, pidFileName),
+	}
+	conf.Binary = fakeDNSMasq(t, conf.PidFile, "printf '%s\\n' \"$@\" > "+argsFile+"\n")
+	expected := []string{"-u", "root", "--conf-file=" + conf.ConfigFile, "--pid-file=" + conf.PidFile}
+	if args := dnsMasqArgs(conf); !reflect.DeepEqual(args, expected) {
+		t.Errorf("Wrong arguments: %v", args)
+	}
+	cmd, err := startDNSMasq(conf)
+	if err != nil {
+		t.Fatalf("Can't start dnsmasq: %v", err)
+	}
+	if !reflect.DeepEqual(cmd.Args, append([]string{conf.Binary}, expected...)) {
+		t.Errorf("Wrong command: %v", cmd.Args)
+	}
+	// the arguments are passed as is, without a shell
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("Can't read arguments: %v", err)
+	}
+	if got := strings.Split(strings.TrimSpace(string(args)), "\n"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong dnsmasq arguments: %v", got)
+	}
+	if pid, err := conf.getProcess(); err != nil || !processAlive(pid.Pid) {
+		t.Errorf("Pid file should point to the live process: %v", err)
+	}
+
+	origTimeout := pidFileTimeout
+	pidFileTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { pidFileTimeout = origTimeout })
+	// the binary exits without writing the pid file
+	conf.PidFile = filepath.Join(tmpDir, "missing")
+	conf.Binary = filepath.Join(tmpDir, "stub")
+	if err := ioutil.WriteFile(conf.Binary, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("Can't write binary: %v", err)
+	}
+	start := time.Now()
+	_, err = startDNSMasq(conf)
+	if !os.IsNotExist(errors.Cause(err)) || !strings.Contains(err.Error(), "didn't write the pid file") {
+		t.Errorf("Missing pid file should be reported, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Waiting for the pid file took too long: %s", elapsed)
+	}
+	// the pid file of the exited process
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatalf("Can't run process: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", exited.Process.Pid)), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+	if _, err := startDNSMasq(conf); errors.Cause(err) != ErrDNSMasqNotRunning {
+		t.Errorf("Dead process should be reported, got: %v", err)
+	}
+}
+
+func TestStartRetries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{PidFile: filepath.Join(tmpDir, pidFileName), StartRetryDelayMs: 1}
+	attempts := 0
+	origStartDNSMasq := startDNSMasq
+	t.Cleanup(func() { startDNSMasq = origStartDNSMasq })
+	startDNSMasq = func(d dnsNameFile) (*exec.Cmd, error) {
+		if attempts++; attempts < 3 {
+			return nil, errors.New("address already in use")
+		}
+		return exec.Command(d.Binary), nil
+	}
+	if err := conf.start(); err != nil {
+		t.Fatalf("Can't start: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Wrong number of attempts: %d", attempts)
+	}
+	// the attempts are limited
+	attempts = 0
+	startDNSMasq = func(d dnsNameFile) (*exec.Cmd, error) {
+		attempts++
+		return nil, errors.New("address already in use")
+	}
+	conf.StartAttempts = 2
+	if err := conf.start(); err == nil || attempts != 2 {
+		t.Errorf("Start should fail after 2 attempts, got: %v, %d attempts", err, attempts)
+	}
+}
+
+func TestQuiesce(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	startedFile := filepath.Join(tmpDir, "started")
+	binary := fakeDNSMasq(t, filepath.Join(tmpDir, pidFileName), "touch "+startedFile+"\n")
+	hostsContent := "192.168.0.1\tpod1\n"
+	conf := dnsNameFile{
+		AddOnHostsFile: filepath.Join(tmpDir, hostsFileName),
+		Binary:         binary,
+		PidFile:        filepath.Join(tmpDir, pidFileName),
+	}
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte(hostsContent), 0644); err != nil {
+		t.Fatalf("Can't write hosts file: %v", err)
+	}
+	if err := conf.quiesce(); err != nil {
+		t.Fatalf("Can't quiesce: %v", err)
+	}
+	if !conf.isQuiesced() {
+		t.Error("Instance should be quiesced")
+	}
+	// reload on ADD must not resume the instance
+	if err := conf.reload(false); err != nil {
+		t.Fatalf("Can't reload: %v", err)
+	}
+	if err := conf.reload(true); err != nil {
+		t.Fatalf("Can't reload: %v", err)
+	}
+	if _, err := os.Stat(startedFile); !os.IsNotExist(err) {
+		t.Error("Quiesced instance should not be started")
+	}
+	data, err := ioutil.ReadFile(conf.AddOnHostsFile)
+	if err != nil || string(data) != hostsContent {
+		t.Errorf("Hosts file should be preserved, got: %s, %v", string(data), err)
+	}
+	if err := conf.resume(); err != nil {
+		t.Fatalf("Can't resume: %v", err)
+	}
+	if conf.isQuiesced() {
+		t.Error("Instance should not be quiesced")
+	}
+	if _, err := os.Stat(startedFile); err != nil {
+		t.Errorf("Resumed instance should be started: %v", err)
+	}
+}
+
+func TestHupRestartsStaleInstance(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	startedFile := filepath.Join(tmpDir, "started")
+	binary := fakeDNSMasq(t, filepath.Join(tmpDir, pidFileName), "echo \"$@\" > "+startedFile+"\n")
+	conf := dnsNameFile{
+		Binary:     binary,
+		ConfigFile: filepath.Join(tmpDir, confFileName),
+		PidFile:    filepath.Join(tmpDir, pidFileName),
+	}
+	// the pid of the exited and reaped process simulates the dead instance
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Can't run process: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+	if err := conf.hup(); err != nil {
+		t.Fatalf("Can't hup: %v", err)
+	}
+	// the restarted instance replaces the stale pid file
+	pid, err := ioutil.ReadFile(conf.PidFile)
+	if err != nil || strings.TrimSpace(string(pid)) == fmt.Sprint(cmd.Process.Pid) {
+		t.Errorf("Stale pid file should be replaced, got: %s, %v", string(pid), err)
+	}
+	args, err := ioutil.ReadFile(startedFile)
+	if err != nil {
+		t.Fatalf("Instance should be started: %v", err)
+	}
+	if !strings.Contains(string(args), "--conf-file="+conf.ConfigFile) {
+		t.Errorf("Instance is started with wrong arguments: %s", string(args))
+	}
+}
+
+func TestReloadDebounce(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	networkDir := filepath.Join(dnsNameConfPath(), "test")
+	if err := os.MkdirAll(networkDir, 0700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	// the instance counts the received sighups
+	hupsFile := filepath.Join(networkDir, "hups")
+	cmd := exec.Command("sh", "-c", "trap 'echo hup >> "+hupsFile+"' HUP; while true; do sleep 0.01; done")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Can't start instance: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	conf := dnsNameFile{PidFile: filepath.Join(networkDir, pidFileName), ReloadDebounceMs: 100}
+	if err := ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+	waitForHUPs := func(expected int) {
+		t.Helper()
+		count := 0
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			data, _ := ioutil.ReadFile(hupsFile)
+			if count = strings.Count(string(data), "hup"); count >= expected {
+				break
+			}
+		}
+		// no more sighups arrive
+		time.Sleep(50 * time.Millisecond)
+		data, _ := ioutil.ReadFile(hupsFile)
+		if count = strings.Count(string(data), "hup"); count != expected {
+			t.Errorf("Wrong number of sighups: %d, expected: %d", count, expected)
+		}
+	}
+
+	// a burst of invocations sends one sighup
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		if err := conf.reload(false); err != nil {
+			t.Fatalf("Can't reload: %v", err)
+		}
+		request, ok := pendingHUPs[conf.PidFile]
+		if !ok {
+			t.Fatal("Sighup should be requested")
+		}
+		delete(pendingHUPs, conf.PidFile)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := request.flush(0); err != nil {
+				t.Errorf("Can't flush sighup: %v", err)
+			}
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := os.Stat(hupsFile); err == nil {
+		t.Error("Sighup should be sent after the burst settles")
+	}
+	wg.Wait()
+	waitForHUPs(1)
+	if _, err := os.Stat(conf.hupStampFile()); !os.IsNotExist(err) {
+		t.Errorf("Served request should be removed: %v", err)
+	}
+
+	// the requests pending for too long are served by any invocation
+	request, err := conf.requestHUP()
+	if err != nil {
+		t.Fatalf("Can't request sighup: %v", err)
+	}
+	if err := ioutil.WriteFile(conf.hupStampFile(), []byte("newer 1\n"), 0644); err != nil {
+		t.Fatalf("Can't write stamp: %v", err)
+	}
+	if err := request.serve(); err != nil {
+		t.Fatalf("Can't serve sighup: %v", err)
+	}
+	waitForHUPs(2)
+
+	// without debounce the sighup is sent at once
+	conf.ReloadDebounceMs = -1
+	if err := conf.reload(false); err != nil {
+		t.Fatalf("Can't reload: %v", err)
+	}
+	if _, ok := pendingHUPs[conf.PidFile]; ok {
+		t.Error("Sighup should not be requested")
+	}
+	waitForHUPs(3)
+}
+
+func TestStopDNSMasq(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		ConfigFile: filepath.Join(tmpDir, confFileName),
+		PidFile:    filepath.Join(tmpDir, pidFileName),
+	}
+	cmd := exec.Command("sh", "-c", "while :; do sleep 1; done", "dnsmasq", "--conf-file="+conf.ConfigFile)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Can't start process: %v", err)
+	}
+	// the child is reaped, so it doesn't linger as a zombie after the signal
+	exited := make(chan *os.ProcessState, 1)
+	go func() {
+		_ = cmd.Wait()
+		exited <- cmd.ProcessState
+	}()
+	waitForExec(t, cmd.Process.Pid, conf.ConfigFile)
+	if err := ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+	if err := stopDNSMasq(conf); err != nil {
+		t.Fatalf("Can't stop dnsmasq: %v", err)
+	}
+	select {
+	case state := <-exited:
+		if status, ok := state.Sys().(syscall.WaitStatus); !ok || !status.Signaled() || status.Signal() != syscall.SIGTERM {
+			t.Errorf("Process should be terminated with SIGTERM: %v", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Process should exit")
+	}
+	if _, err := os.Stat(conf.PidFile); !os.IsNotExist(err) {
+		t.Error("Pid file should be removed")
+	}
+	// the stale pid file of the dead instance is removed too
+	if err := ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+	if err := stopDNSMasq(conf); err != nil {
+		t.Errorf("Stopping dead instance should succeed: %v", err)
+	}
+	if _, err := os.Stat(conf.PidFile); !os.IsNotExist(err) {
+		t.Error("Stale pid file should be removed")
+	}
+	// the reused pid of another process, the test itself, is not signaled
+	if err := ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+	if err := stopDNSMasq(conf); err != nil {
+		t.Errorf("Stopping the process of another owner should succeed: %v", err)
+	}
+	if _, err := os.Stat(conf.PidFile); !os.IsNotExist(err) {
+		t.Error("Pid file of another process should be removed")
+	}
+}
+
+func TestWaitForProcess(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{PidFile: filepath.Join(tmpDir, pidFileName)}
+	// simulate dnsmasq writing the pid file with a delay after spawn
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+	}()
+	pid, err := conf.waitForProcess()
+	if err != nil {
+		t.Fatalf("Can't wait for process: %v", err)
+	}
+	if pid.Pid != os.Getpid() {
+		t.Errorf("Wrong pid: %d", pid.Pid)
+	}
+
+	origTimeout := pidFileTimeout
+	pidFileTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { pidFileTimeout = origTimeout })
+	conf.PidFile = filepath.Join(tmpDir, "missing")
+	if _, err := conf.waitForProcess(); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error, got: %v", err)
+	}
+}
+
+func TestRotateLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conf := dnsNameFile{
+		PidFile:      filepath.Join(tmpDir, pidFileName),
+		LogFile:      filepath.Join(tmpDir, queryLogFileName),
+		MaxLogSizeKB: 1,
+	}
+	if err := ioutil.WriteFile(conf.LogFile, make([]byte, 1024), 0644); err != nil {
+		t.Fatalf("Can't write log: %v", err)
+	}
+	if err := conf.rotateLog(); err != nil {
+		t.Fatalf("Can't rotate log: %v", err)
+	}
+	if _, err := os.Stat(conf.LogFile + ".1"); !os.IsNotExist(err) {
+		t.Error("Log within the max size should not be rotated")
+	}
+	if err := ioutil.WriteFile(conf.LogFile, make([]byte, 1025), 0644); err != nil {
+		t.Fatalf("Can't write log: %v", err)
+	}
+	if err := conf.rotateLog(); err != nil {
+		t.Fatalf("Can't rotate log: %v", err)
+	}
+	if _, err := os.Stat(conf.LogFile); !os.IsNotExist(err) {
+		t.Error("Log should be rotated")
+	}
+	if info, err := os.Stat(conf.LogFile + ".1"); err != nil || info.Size() != 1025 {
+		t.Errorf("Rotated log is not kept: %v", err)
+	}
+}
+
+// startInstance starts the process with the dnsmasq command line of the config
+// and waits until the command line is visible
+func startInstance(t *testing.T, configFile string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("sh", "-c", "sleep 10", "dnsmasq", "--conf-file="+configFile)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Can't start process: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	waitForExec(t, cmd.Process.Pid, configFile)
+	return cmd
+}
+
+// waitForExec waits until the command line of the started instance is visible,
+// it is the one of the test until the process execs
+func waitForExec(t *testing.T, pid int, configFile string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		cmdline, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if strings.Contains(string(cmdline), "--conf-file="+configFile) {
+			return
+		}
+	}
+	t.Fatal("Process didn't exec")
+}
+
+func TestCheckForeignDNSMasq(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer conn.Close()
+	conf := dnsNameFile{
+		ConfigFile: filepath.Join(tmpDir, confFileName),
+		PidFile:    filepath.Join(tmpDir, pidFileName),
+		DNSPort:    conn.LocalAddr().(*net.UDPAddr).Port,
+	}
+
+	// no pid file and port bound
+	if err := conf.checkForeignDNSMasq([]string{"127.0.0.1"}); errors.Cause(err) != ErrForeignDNSMasq {
+		t.Errorf("Expected foreign dnsmasq error, got: %v", err)
+	}
+	// port bound on another address
+	if err := conf.checkForeignDNSMasq([]string{"127.0.0.2"}); err != nil {
+		t.Errorf("Foreign dnsmasq should not be detected: %v", err)
+	}
+
+	// plugin instance running
+	cmd := startInstance(t, conf.ConfigFile)
+	if err := ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+	if err := conf.checkForeignDNSMasq([]string{"127.0.0.1"}); err != nil {
+		t.Errorf("Plugin instance should not be detected as foreign: %v", err)
+	}
+
+	// pid file pointing to another process
+	if err := ioutil.WriteFile(conf.PidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644); err != nil {
+		t.Fatalf("Can't write pid file: %v", err)
+	}
+	if err := conf.checkForeignDNSMasq([]string{"127.0.0.2"}); err != nil {
+		t.Errorf("Foreign dnsmasq should not be detected: %v", err)
+	}
+	if _, err := os.Stat(conf.PidFile); !os.IsNotExist(err) {
+		t.Error("Stale pid file should be removed")
+	}
+}
+
+func TestCheckDNSPort(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	err = checkDNSPort("127.0.0.1", port)
+	if errors.Cause(err) != ErrDNSPortInUse {
+		t.Fatalf("Expected port conflict, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("process %d", os.Getpid())) {
+		t.Errorf("Conflict should name the process holding the port: %v", err)
+	}
+	if err := checkDNSPort("127.0.0.2", port); err != nil {
+		t.Errorf("Port of another address should be free: %v", err)
+	}
+
+	// the start failure of dnsmasq is reported as the conflict
+	tmpDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	binary := filepath.Join(tmpDir, "dnsmasq")
+	script := "#!/bin/sh\necho 'dnsmasq: failed to create listening socket for port 53: Address in use' >&2\nexit 2\n"
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatalf("Can't write binary: %v", err)
+	}
+	conf := dnsNameFile{
+		Binary:     binary,
+		ConfigFile: filepath.Join(tmpDir, confFileName),
+		PidFile:    filepath.Join(tmpDir, pidFileName),
+	}
+	if _, err := startDNSMasq(conf); errors.Cause(err) != ErrDNSPortInUse {
+		t.Errorf("Expected port conflict, got: %v", err)
+	}
+}
+
+func TestListInstances(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	for _, networkName := range []string{"alive", "stale", "foreign", "missing", "broken"} {
+		if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), networkName), 0700); err != nil {
+			t.Fatalf("Can't create network dir: %v", err)
+		}
+		if err := ioutil.WriteFile(makePath(networkName, interfaceFileName), []byte("cni-"+networkName+"\n"), 0644); err != nil {
+			t.Fatalf("Can't write interface file: %v", err)
+		}
+	}
+	// the files in the root are not networks
+	if err := ioutil.WriteFile(filepath.Join(dnsNameConfPath(), "lock"), nil, 0644); err != nil {
+		t.Fatalf("Can't write lock file: %v", err)
+	}
+	writePid := func(networkName string, pid int) {
+		t.Helper()
+		if err := ioutil.WriteFile(makePath(networkName, pidFileName), []byte(fmt.Sprintf("%d\n", pid)), 0644); err != nil {
+			t.Fatalf("Can't write pid file: %v", err)
+		}
+	}
+	cmd := startInstance(t, makePath("alive", confFileName))
+	writePid("alive", cmd.Process.Pid)
+	// the pid of the exited and reaped process
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatalf("Can't run process: %v", err)
+	}
+	writePid("stale", exited.Process.Pid)
+	writePid("foreign", os.Getpid())
+	// the unreadable pid file
+	if err := os.Mkdir(makePath("broken", pidFileName), 0700); err != nil {
+		t.Fatalf("Can't create pid dir: %v", err)
+	}
+
+	statuses, err := listInstances()
+	if err != nil {
+		t.Fatalf("Can't list instances: %v", err)
+	}
+	expected := map[string]instanceStatus{
+		"alive":   {Network: "alive", Interface: "cni-alive", PID: cmd.Process.Pid, Status: instanceAlive},
+		"stale":   {Network: "stale", Interface: "cni-stale", PID: exited.Process.Pid, Status: instanceDead},
+		"foreign": {Network: "foreign", Interface: "cni-foreign", PID: os.Getpid(), Status: instanceDead},
+		"missing": {Network: "missing", Interface: "cni-missing", Status: instanceMissing},
+	}
+	if len(statuses) != len(expected)+1 {
+		t.Fatalf("Wrong number of instances: %+v", statuses)
+	}
+	for _, status := range statuses {
+		if status.Network == "broken" {
+			if status.Status != instanceUnknown || status.Error == "" {
+				t.Errorf("Unreadable pid file should be reported: %+v", status)
+			}
+			continue
+		}
+		if status != expected[status.Network] {
+			t.Errorf("Wrong status: %+v, expected: %+v", status, expected[status.Network])
+		}
+	}
+}
+
+func TestMakePathConfDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(confDirEnv, dir)
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	origConfDir := confDir
+	t.Cleanup(func() { confDir = origConfDir })
+	confDir = resolveConfDir()
+	if got := makePath("net1", hostsFileName); got != filepath.Join(dir, "net1", hostsFileName) {
+		t.Errorf("makePath() got = %s, want the path in %s", got, dir)
+	}
+	// the directory is resolved once
+	t.Setenv(confDirEnv, "")
+	if got := dnsNameConfPath(); got != dir {
+		t.Errorf("dnsNameConfPath() got = %s, want the resolved %s", got, dir)
+	}
+	if got := resolveConfDir(); got != "/run/user/1000/containers/cni/dnsname" {
+		t.Errorf("resolveConfDir() got = %s, want the path in XDG_RUNTIME_DIR", got)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// networkState is the managed state of the network. It allows to reconstruct
+// the network after the loss of the runtime cache and helps debugging.
+type networkState struct {
+	Network string      `json:"network"`
+	Options dnsNameFile `json:"options"`
+	Entries []PodEntry  `json:"entries"`
+	// Firewall tells whether the firewall rule of the network interface exists
+	Firewall bool `json:"firewall"`
+}
+
+// exportState collects the managed state of the network
+func exportState(networkName string) (networkState, error) {
+	conf, err := loadDNSMasqFile(networkName)
+	if err != nil {
+		return networkState{}, err
+	}
+	entries, err := readHostEntries(conf.AddOnHostsFile)
+	if err != nil {
+		return networkState{}, err
+	}
+	firewall, err := conf.firewall().hasAllow(conf.NetworkInterface, conf.port())
+	if err != nil {
+		return networkState{}, err
+	}
+	return networkState{Network: networkName, Options: conf, Entries: entries, Firewall: firewall}, nil
+}
+
+// marshalState serializes the network state to JSON
+func marshalState(state networkState) ([]byte, error) {
+	return json.MarshalIndent(state, "", "  ")
+}
+
+// unmarshalState deserializes the network state from JSON
+func unmarshalState(data []byte) (networkState, error) {
+	var state networkState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return networkState{}, errors.Wrap(err, "invalid network state")
+	}
+	if state.Network == "" {
+		return networkState{}, errors.Errorf("network state has no network name")
+	}
+	if filepath.Dir(state.Options.PidFile) != filepath.Join(dnsNameConfPath(), state.Network) {
+		return networkState{}, errors.Errorf("network state options don't belong to network %s", state.Network)
+	}
+	return state, nil
+}
+
+// restoreState restores the missing parts of the network state and verifies
+// the existing ones. The entries present with other addresses are reported as
+// an error, as they can't be restored without breaking the running pods.
+func restoreState(state networkState) error {
+	conf := state.Options
+	// the stored binary may be gone since the state was saved
+	if _, err := findBinary(conf.Binary); err != nil {
+		return err
+	}
+	if err := claimInterface(conf); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.PidFile), 0700); err != nil {
+		return err
+	}
+	if err := checkForDNSMasqConfFile(conf); err != nil {
+		return err
+	}
+	if err := conf.save(); err != nil {
+		return err
+	}
+	entries, err := readHostEntries(conf.AddOnHostsFile)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]PodEntry)
+	for _, entry := range entries {
+		existing[hostNameKey(entry.Name)] = entry
+	}
+	restored := 0
+	for _, entry := range state.Entries {
+		if current, ok := existing[hostNameKey(entry.Name)]; ok {
+			if !sameIPs(current.IPs, entry.IPs) {
+				return errors.Errorf("entry %s has addresses different from the network state", entry.Name)
+			}
+			continue
+		}
+		if err := appendToFile(conf.AddOnHostsFile, entry.Name, entry.Aliases, entry.IPs, conf.fileMode()); err != nil {
+			return err
+		}
+		restored++
+	}
+	if state.Firewall {
+		if err := conf.firewall().ensureAllow(conf.NetworkInterface, conf.port()); err != nil {
+			return err
+		}
+	}
+	if restored == 0 {
+		if isRunning, _ := conf.isRunning(); isRunning {
+			return nil
+		}
+	}
+	return conf.hup()
+}
+
+// persistState writes the snapshot of the network state into the persist
+// directory, so the network kept on tmpfs can be restored after reboot. The
+// snapshot is skipped if the previous one is newer than the persist interval
+// to limit the flash wear.
+func (d dnsNameFile) persistState() error {
+	if d.PersistDir == "" {
+		return nil
+	}
+	networkName := filepath.Base(filepath.Dir(d.PidFile))
+	snapshot := d.snapshotFile()
+	if info, err := os.Stat(snapshot); err == nil &&
+		time.Since(info.ModTime()) < time.Duration(d.PersistInterval)*time.Second {
+		return nil
+	}
+	state, err := exportState(networkName)
+	if err != nil {
+		return err
+	}
+	data, err := marshalState(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.PersistDir, 0700); err != nil {
+		return err
+	}
+	// the snapshot is replaced atomically not to lose it on power loss
+	return writeFileAtomic(snapshot, data, 0600)
+}
+
+// removeSnapshot removes the snapshot of the network removed with the last pod
+func (d dnsNameFile) removeSnapshot() error {
+	if d.PersistDir == "" {
+		return nil
+	}
+	if err := os.Remove(d.snapshotFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// snapshotFile returns the path of the network state snapshot
+func (d dnsNameFile) snapshotFile() string {
+	return filepath.Join(d.PersistDir, filepath.Base(filepath.Dir(d.PidFile))+".json")
+}
+
+// readHostEntries reads the pod entries of the hosts file, the lines of the
+// same pod are merged into one entry
+func readHostEntries(path string) ([]PodEntry, error) {
+	hostEntries, err := listEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []PodEntry
+	index := make(map[string]int)
+	for _, hostEntry := range hostEntries {
+		ip := &net.IPNet{IP: hostEntry.IP}
+		if i, ok := index[hostNameKey(hostEntry.Name)]; ok {
+			entries[i].IPs = append(entries[i].IPs, ip)
+			continue
+		}
+		index[hostNameKey(hostEntry.Name)] = len(entries)
+		entries = append(entries, PodEntry{Name: hostEntry.Name, Aliases: hostEntry.Aliases, IPs: []*net.IPNet{ip}})
+	}
+	return entries, nil
+}
+
+// sameIPs checks whether both lists contain the same addresses in the same order
+func sameIPs(a, b []*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].IP.Equal(b[i].IP) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	fake := newFakeIPTables(t)
+	binary := fakeDNSMasq(t, makePath("net1", pidFileName), "")
+	if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), "net1"), 0700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	conf := dnsNameFile{
+		AddOnHostsFile:   makePath("net1", hostsFileName),
+		Binary:           binary,
+		ConfigFile:       makePath("net1", confFileName),
+		Domain:           "net1.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("net1", pidFileName),
+		InterfaceFile:    makePath("net1", interfaceFileName),
+	}
+	if err := conf.save(); err != nil {
+		t.Fatalf("Can't save options: %v", err)
+	}
+	hosts := "192.168.0.1\tpod1\taliasPod1\nfd00::1\tpod1\taliasPod1\n192.168.0.2\tpod2\n"
+	if err := ioutil.WriteFile(conf.AddOnHostsFile, []byte(hosts), 0644); err != nil {
+		t.Fatalf("Can't write hosts file: %v", err)
+	}
+	if err := addIPTablesChain(conf.NetworkInterface, conf.port(), true, ipTablesPlacement{}); err != nil {
+		t.Fatalf("Can't add iptables rule: %v", err)
+	}
+
+	state, err := exportState("net1")
+	if err != nil {
+		t.Fatalf("Can't export state: %v", err)
+	}
+	if len(state.Entries) != 2 || len(state.Entries[0].IPs) != 2 || !state.Firewall {
+		t.Errorf("Wrong exported state: %+v", state)
+	}
+	data, err := marshalState(state)
+	if err != nil {
+		t.Fatalf("Can't marshal state: %v", err)
+	}
+	loaded, err := unmarshalState(data)
+	if err != nil {
+		t.Fatalf("Can't unmarshal state: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, state) {
+		t.Errorf("Wrong unmarshalled state: %+v, expected: %+v", loaded, state)
+	}
+
+	// restore after the loss of the network
+	if err := cleanupAll(); err != nil {
+		t.Fatalf("Can't remove networks: %v", err)
+	}
+	fake.rules = make(map[string]bool)
+	if err := restoreState(loaded); err != nil {
+		t.Fatalf("Can't restore state: %v", err)
+	}
+	restored, err := exportState("net1")
+	if err != nil {
+		t.Fatalf("Can't export state: %v", err)
+	}
+	if !reflect.DeepEqual(restored, state) {
+		t.Errorf("Wrong restored state: %+v, expected: %+v", restored, state)
+	}
+	if _, err := os.Stat(conf.ConfigFile); err != nil {
+		t.Errorf("Config is not restored: %v", err)
+	}
+
+	// existing entries are verified
+	loaded.Entries[1].IPs[0].IP = []byte{192, 168, 0, 3}
+	if err := restoreState(loaded); err == nil {
+		t.Error("Entry with different address should not be restored")
+	}
+	if _, err := unmarshalState([]byte(`{"network": "net2", "options": {"PidFile": "/tmp/pidfile"}}`)); err == nil {
+		t.Error("Options of another network should not be accepted")
+	}
+}
+
+func TestPersistState(t *testing.T) {
+	t.Cleanup(func() { cleanupAll() })
+	newFakeIPTables(t)
+	persistDir, err := ioutil.TempDir("", "cni_*")
+	if err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(persistDir) })
+	binary := fakeDNSMasq(t, makePath("net1", pidFileName), "")
+	if err := os.MkdirAll(filepath.Join(dnsNameConfPath(), "net1"), 0700); err != nil {
+		t.Fatalf("Can't create network dir: %v", err)
+	}
+	conf := dnsNameFile{
+		AddOnHostsFile:   makePath("net1", hostsFileName),
+		Binary:           binary,
+		ConfigFile:       makePath("net1", confFileName),
+		Domain:           "net1.org",
+		NetworkInterface: "cni0",
+		PidFile:          makePath("net1", pidFileName),
+		InterfaceFile:    makePath("net1", interfaceFileName),
+		PersistDir:       persistDir,
+		PersistInterval:  3600,
+	}
+	if err := conf.save(); err != nil {
+		t.Fatalf("Can't save options: %v", err)
+	}
+	if err := appendToFile(conf.AddOnHostsFile, "pod1", nil, []*net.IPNet{{IP: net.IP{192, 168, 0, 1}}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	if err := conf.persistState(); err != nil {
+		t.Fatalf("Can't persist state: %v", err)
+	}
+	// the snapshot is not rewritten within the persist interval
+	if err := appendToFile(conf.AddOnHostsFile, "pod2", nil, []*net.IPNet{{IP: net.IP{192, 168, 0, 2}}}, defaultFileMode); err != nil {
+		t.Fatalf("Can't append to file: %v", err)
+	}
+	if err := conf.persistState(); err != nil {
+		t.Fatalf("Can't persist state: %v", err)
+	}
+
+	// restore after reboot
+	if err := cleanupAll(); err != nil {
+		t.Fatalf("Can't remove networks: %v", err)
+	}
+	if err := restoreSnapshots(persistDir); err != nil {
+		t.Fatalf("Can't restore snapshots: %v", err)
+	}
+	entries, err := readHostEntries(conf.AddOnHostsFile)
+	if err != nil {
+		t.Fatalf("Can't read entries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "pod1" {
+		t.Errorf("Wrong restored entries: %+v", entries)
+	}
+
+	if err := conf.removeSnapshot(); err != nil {
+		t.Fatalf("Can't remove snapshot: %v", err)
+	}
+	if _, err := os.Stat(conf.snapshotFile()); !os.IsNotExist(err) {
+		t.Error("Snapshot should be removed")
+	}
+}